@@ -1,18 +1,20 @@
 package main
 
 import (
-	"crypto/sha256"
 	"encoding/binary"
 	"fmt"
 	"log"
 	"net/http"
+	"strings"
 	"sync"
+	"time"
 )
 
 type BlockData struct {
-	Hash     [32]byte `json:"hash"`
-	Previous [32]byte `json:"previous"`
-	Commits  [][32]byte `json:"commits"`
+	Hash     [32]byte    `json:"hash"`
+	Previous [32]byte    `json:"previous"`
+	Commits  [][32]byte  `json:"commits"`
+	Header   BlockHeader `json:"-"`
 }
 
 type ChainData struct {
@@ -23,26 +25,95 @@ type ChainData struct {
 
 var BTC struct {
 	RestClient *http.Client
+	RestLock   sync.Mutex //RestURL and Alert are only changed by the sync, but the mempool watcher and rpcs read them too
 	RestURL    string
+	Backends   []Backend
+	Alert      string
 	DirectPath string
+	DirectKey  [8]byte
+	Offline    bool
+	P2PAddr    string
+	EsploraURL string
 	Chain      ChainData
+	Notify     chan struct{}
+	Blocks     chan BlockData
 }
 
 func btc_init() {
-	BTC.RestURL = fmt.Sprintf("http://%s:%d/rest", *btc_peer, *btc_port)
-	BTC.RestClient = &http.Client{}
+	backend_init()
+	BTC.RestClient = &http.Client{
+		Transport: &http.Transport{MaxIdleConnsPerHost: int(*btc_rest_workers)},
+	}
 
-	if err := direct_check_path(*btc_data); err != nil {
+	if key, err := direct_check_path(*btc_data); err != nil {
 		log.Printf("(btc) direct mining disabled (%s)\n", err.Error())
 	} else {
 		BTC.DirectPath = *btc_data
+		BTC.DirectKey = key
+	}
+
+	if *btc_offline {
+		if BTC.DirectPath == "" {
+			log.Panicf("(btc) offline mining needs a readable btc_data\n")
+		}
+		BTC.Offline = true
+		log.Printf("(btc) mining offline from %s\n", BTC.DirectPath)
+	}
+
+	if *btc_p2p != "" {
+		BTC.P2PAddr = *btc_p2p
+		log.Printf("(btc) using p2p peer %s\n", BTC.P2PAddr)
+	}
+
+	if *btc_esplora != "" {
+		BTC.EsploraURL = strings.TrimSuffix(*btc_esplora, "/")
+		log.Printf("(btc) using esplora %s\n", BTC.EsploraURL)
+	}
+
+	BTC.Notify = make(chan struct{}, 1)
+	BTC.Blocks = make(chan BlockData, 16)
+	if *btc_zmq != "" && !BTC.Offline {
+		go zmq_listen(*btc_zmq)
+	}
+	if *btc_mempool && !BTC.Offline {
+		log.Printf("(btc) watching mempool\n")
+		go mempool_watch(BTC.RestClient)
+	}
+}
+
+func btc_notify() {
+	select {
+	case BTC.Notify <- struct{}{}:
+	default: //a sync is already pending
+	}
+}
+
+func btc_wait(timeout time.Duration) {
+	//wait for bitcoin core to announce a block, or just poll again once the timeout is hit
+	var timer *time.Timer = time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case block := <-BTC.Blocks:
+		if block.Previous != COMBInfo.Hash {
+			return //doesnt build on our tip, needs a full sync
+		}
+		pow_cache_header(block.Header)
+		if err := pow_check_chain([][32]byte{block.Hash}, btc_header_source()); err != nil {
+			log.Printf("(btc) rejecting block %X (%s)\n", block.Hash, err.Error())
+			return
+		}
+		log.Printf("(btc) got block %X\n", block.Hash)
+		neominer_process_block(block)
+		neominer_write()
+	case <-BTC.Notify:
+	case <-timer.C:
 	}
 }
 
 func btc_sync() {
 	var err error
 	var delta int64
-	if BTC.Chain, err = rest_get_chains(BTC.RestClient, BTC.RestURL); err != nil {
+	if BTC.Chain, err = btc_get_chains(); err != nil {
 		log.Printf("(btc) failed to get chains (%s)\n", err.Error())
 		BTC.Chain.KnownHeight = 0 //signals we are disconnected
 		return
@@ -78,99 +149,263 @@ func btc_sync() {
 	wait.Lock() //dont leave before neominer is finished (only a problem if we use a buffered channel)
 }
 
+func btc_get_chains() (chain ChainData, err error) {
+	if BTC.Offline {
+		return offline_get_chains(BTC.DirectPath)
+	}
+	if BTC.P2PAddr != "" {
+		return p2p_get_chains(BTC.P2PAddr)
+	}
+	if BTC.EsploraURL != "" {
+		return esplora_get_chains(BTC.RestClient, BTC.EsploraURL)
+	}
+	return backend_get_chains()
+}
+
+func btc_header_source() HeaderSource {
+	//where to fetch headers for blocks that arrive outside of a normal sync
+	if BTC.Offline {
+		return offline_header_source()
+	}
+	if BTC.P2PAddr != "" {
+		return p2p_header_source(nil)
+	}
+	if BTC.EsploraURL != "" {
+		return esplora_header_source(BTC.RestClient, BTC.EsploraURL)
+	}
+	return rest_header_source(BTC.RestClient, BTC.RestURL)
+}
+
 func btc_get_block_range(target [32]byte, chain *map[[32]byte][32]byte, delta uint64, blocks chan<- BlockData) (err error) {
-	if BTC.DirectPath != "" && delta > 10 { //use direct mining if its available and delta is big enough (>10)
+	if BTC.DirectPath != "" && (delta > 10 || BTC.Offline) { //use direct mining if its available and delta is big enough (>10)
 		if err = direct_get_block_range(BTC.DirectPath, target, chain, delta, blocks); err != nil {
 			return err
 		}
+	} else if BTC.P2PAddr != "" {
+		if err = p2p_get_block_range(BTC.P2PAddr, target, chain, delta, blocks); err != nil {
+			return err
+		}
+	} else if BTC.EsploraURL != "" {
+		if err = esplora_get_block_range(BTC.RestClient, BTC.EsploraURL, target, chain, delta, blocks); err != nil {
+			return err
+		}
 	} else {
 		if err = rest_get_block_range(BTC.RestClient, BTC.RestURL, target, chain, delta, blocks); err != nil {
+			backend_set_failed(true)
 			return err
 		}
+		backend_set_failed(false)
+	}
+	return nil
+}
+
+type FetchResult struct {
+	Block BlockData
+	Err   error
+}
+
+func btc_fetch_ordered(chain [][32]byte, workers int, length uint64, out chan<- BlockData, fetch func([32]byte) (BlockData, error)) (err error) {
+	//fetch blocks with up to workers requests in flight, results are queued in chain order so the output is too
+	if workers < 1 {
+		workers = 1
+	}
+	var pending chan chan FetchResult = make(chan chan FetchResult, workers-1)
+	var quit chan struct{} = make(chan struct{})
+
+	go func() {
+		defer close(pending)
+		for _, h := range chain {
+			var result chan FetchResult = make(chan FetchResult, 1)
+			select {
+			case <-quit: //select picks at random if both are ready, so check first
+				return
+			default:
+			}
+			select {
+			case pending <- result:
+			case <-quit:
+				return
+			}
+			go func(hash [32]byte) {
+				var r FetchResult
+				r.Block, r.Err = fetch(hash)
+				result <- r
+			}(h)
+		}
+	}()
+
+	var i int
+	for result := range pending {
+		r := <-result
+		if r.Err != nil {
+			//stop queuing new fetches and wait for the ones in flight to finish
+			close(quit)
+			for result := range pending {
+				<-result
+			}
+			return r.Err
+		}
+		var progress float64 = (float64(i) / float64(length)) * 100.0
+		combcore_set_status(fmt.Sprintf("Mining (%.2f%%)...", progress))
+		out <- r.Block
+		i++
 	}
 	return nil
 }
-func btc_parse_varint(data []byte) (value uint64, advance uint8) {
+
+func btc_parse_varint(data []byte) (value uint64, advance uint8, err error) {
 	//parse a BTC varint. see https://learnmeabitcoin.com/technical/varint
 
+	if len(data) == 0 {
+		return 0, 0, fmt.Errorf("varint is truncated")
+	}
 	prefix := data[0]
 
 	switch prefix {
 	case 0xfd:
-		value = uint64(binary.LittleEndian.Uint16(data[1:]))
 		advance = 3
 	case 0xfe:
-		value = uint64(binary.LittleEndian.Uint32(data[1:]))
 		advance = 5
 	case 0xff:
-		value = uint64(binary.LittleEndian.Uint64(data[1:]))
 		advance = 9
 	default:
-		value = uint64(prefix)
-		advance = 1
+		return uint64(prefix), 1, nil
 	}
 
-	return value, advance
+	if len(data) < int(advance) {
+		return 0, 0, fmt.Errorf("varint is truncated")
+	}
+	switch prefix {
+	case 0xfd:
+		value = uint64(binary.LittleEndian.Uint16(data[1:]))
+	case 0xfe:
+		value = uint64(binary.LittleEndian.Uint32(data[1:]))
+	case 0xff:
+		value = binary.LittleEndian.Uint64(data[1:])
+	}
+
+	return value, advance, nil
 }
 
-func btc_parse_block(data []byte, block *BlockData) {
-	//parse a raw BTC block. see https://learnmeabitcoin.com/technical/blkdat
+func btc_skip(data []byte, size uint64, what string) ([]byte, error) {
+	if size > uint64(len(data)) {
+		return nil, fmt.Errorf("%s is truncated (need %d bytes, have %d)", what, size, len(data))
+	}
+	return data[size:], nil
+}
 
-	var current_commit [32]byte
-	block.Hash = sha256.Sum256(data[0:80])
-	block.Hash = sha256.Sum256(block.Hash[:])
-	data = data[4:] //version(4)
-	copy(block.Previous[:], data[0:32])
-	data = data[32:] //previous(32)
-	data = data[44:] //merkle root(32),time(4),bits(4),nonce(4)
+func btc_read_varint(data []byte, what string) (value uint64, rest []byte, err error) {
+	var adv uint8
+	if value, adv, err = btc_parse_varint(data); err != nil {
+		return 0, nil, fmt.Errorf("%s %s", what, err.Error())
+	}
+	//every counted item takes at least a byte, so anything bigger than the buffer is garbage
+	rest = data[adv:]
+	if value > uint64(len(rest)) {
+		return 0, nil, fmt.Errorf("%s is too large (%d with %d bytes left)", what, value, len(rest))
+	}
+	return value, rest, nil
+}
 
-	tx_count, adv := btc_parse_varint(data[:])
-	data = data[adv:] //tx count(var)
+func btc_parse_transaction(data []byte, commits [][32]byte) (rest []byte, out [][32]byte, err error) {
+	//parse a single raw BTC transaction, appending any P2WSH outputs to commits
 
+	var current_commit [32]byte
 	var segwit bool
-	for t := 0; t < int(tx_count); t++ {
-		segwit = false
-		data = data[4:] //version(4)
-		in_count, adv := btc_parse_varint(data[:])
-
-		if in_count == 0 { //segwit marker is 0x00
-			segwit = true
-			data = data[2:] //marker(1),flag(1)
-			in_count, adv = btc_parse_varint(data[:])
-		}
-
-		data = data[adv:] //vin count(var)
-		for i := 0; i < int(in_count); i++ {
-			data = data[36:] //txid(32), vout(4)
-			sig_size, adv := btc_parse_varint(data[:])
-			data = data[uint64(adv)+sig_size+4:] //sig size(var), sig(var),sequence(4)
-		}
-		out_count, adv := btc_parse_varint(data[:])
-		data = data[adv:] //vout count(var)
-		for i := 0; i < int(out_count); i++ {
-			data = data[8:] //value(8)
-			pub_size, adv := btc_parse_varint(data[:])
-			data = data[uint64(adv):] //pub size(var)
-			if pub_size == 34 && data[0] == 0 && data[1] == 32 {
-				copy(current_commit[:], data[2:34])
-				block.Commits = append(block.Commits, current_commit)
+	var in_count, out_count, size uint64
+
+	if data, err = btc_skip(data, 4, "version"); err != nil { //version(4)
+		return nil, commits, err
+	}
+	if in_count, _, err = btc_read_varint(data, "vin count"); err != nil {
+		return nil, commits, err
+	}
+	if in_count == 0 { //segwit marker is 0x00
+		segwit = true
+		if data, err = btc_skip(data, 2, "segwit flag"); err != nil { //marker(1),flag(1)
+			return nil, commits, err
+		}
+	}
+	if in_count, data, err = btc_read_varint(data, "vin count"); err != nil { //vin count(var)
+		return nil, commits, err
+	}
+
+	for i := uint64(0); i < in_count; i++ {
+		if data, err = btc_skip(data, 36, "input"); err != nil { //txid(32), vout(4)
+			return nil, commits, err
+		}
+		if size, data, err = btc_read_varint(data, "sig size"); err != nil { //sig size(var)
+			return nil, commits, err
+		}
+		if data, err = btc_skip(data, size+4, "sig"); err != nil { //sig(var),sequence(4)
+			return nil, commits, err
+		}
+	}
+
+	if out_count, data, err = btc_read_varint(data, "vout count"); err != nil { //vout count(var)
+		return nil, commits, err
+	}
+	for i := uint64(0); i < out_count; i++ {
+		if data, err = btc_skip(data, 8, "value"); err != nil { //value(8)
+			return nil, commits, err
+		}
+		if size, data, err = btc_read_varint(data, "pub size"); err != nil { //pub size(var)
+			return nil, commits, err
+		}
+		if size == 34 && len(data) >= 34 && data[0] == 0 && data[1] == 32 {
+			copy(current_commit[:], data[2:34])
+			commits = append(commits, current_commit)
+		}
+		if data, err = btc_skip(data, size, "pub"); err != nil { //pub (var)
+			return nil, commits, err
+		}
+	}
+
+	if segwit {
+		for i := uint64(0); i < in_count; i++ {
+			var witness_count uint64
+			if witness_count, data, err = btc_read_varint(data, "witness count"); err != nil { //witness count(var)
+				return nil, commits, err
 			}
-			data = data[pub_size:] //pub (var)
-		}
-		if segwit {
-			for i := 0; i < int(in_count); i++ {
-				witness_count, adv := btc_parse_varint(data[:])
-				data = data[adv:] //witness count(var)
-				for w := 0; w < int(witness_count); w++ {
-					witness_size, adv := btc_parse_varint(data[:])
-					data = data[uint64(adv)+witness_size:] //witness size(var), witness(var)
+			for w := uint64(0); w < witness_count; w++ {
+				if size, data, err = btc_read_varint(data, "witness size"); err != nil { //witness size(var)
+					return nil, commits, err
+				}
+				if data, err = btc_skip(data, size, "witness"); err != nil { //witness(var)
+					return nil, commits, err
 				}
 			}
 		}
-		data = data[4:] //locktime(4)
 	}
 
-	//we use big endian in haircomb, btc uses little endian for some values
-	block.Hash = swap_endian(block.Hash)
-	block.Previous = swap_endian(block.Previous)
+	if data, err = btc_skip(data, 4, "locktime"); err != nil { //locktime(4)
+		return nil, commits, err
+	}
+	return data, commits, nil
+}
+
+func btc_parse_block(data []byte, block *BlockData) (err error) {
+	//parse a raw BTC block. see https://learnmeabitcoin.com/technical/blkdat
+
+	if block.Header, err = btc_parse_header(data); err != nil {
+		return fmt.Errorf("block %s", err.Error())
+	}
+	data = data[80:] //version(4),previous(32),merkle root(32),time(4),bits(4),nonce(4)
+
+	//we use big endian in haircomb, btc uses little endian for some values (btc_parse_header swaps them)
+	block.Hash = block.Header.Hash
+	block.Previous = block.Header.Previous
+
+	var tx_count uint64
+	if tx_count, data, err = btc_read_varint(data, "tx count"); err != nil { //tx count(var)
+		return fmt.Errorf("block %X malformed (%s)", block.Hash, err.Error())
+	}
+
+	block.Commits = nil
+	for t := uint64(0); t < tx_count; t++ {
+		if data, block.Commits, err = btc_parse_transaction(data, block.Commits); err != nil {
+			return fmt.Errorf("block %X malformed in tx %d (%s)", block.Hash, t, err.Error())
+		}
+	}
+	return nil
 }
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+)
+
+//a list of bitcoin core REST backends, the first healthy one is used and the rest are checked against it
+
+const BACKEND_ALERT_POLLS = 3 //backends see new blocks seconds apart, so only a tip that differs this many polls in a row is an alert
+
+type Backend struct {
+	URL      string
+	Healthy  bool
+	Failed   bool //a block fetch failed, prefer another backend until a sync succeeds
+	Chain    ChainData
+	Disagree int //polls in a row its tip differed from the active one
+}
+
+func backend_init() {
+	BTC.Backends = []Backend{{URL: fmt.Sprintf("http://%s:%d/rest", *btc_peer, *btc_port), Healthy: true}}
+	for _, b := range strings.Split(*btc_backends, ",") {
+		b = strings.TrimSpace(b)
+		if b == "" {
+			continue
+		}
+		if !strings.HasPrefix(b, "http://") && !strings.HasPrefix(b, "https://") {
+			b = "http://" + b
+		}
+		BTC.Backends = append(BTC.Backends, Backend{URL: strings.TrimSuffix(b, "/") + "/rest", Healthy: true})
+	}
+	backend_set_url(BTC.Backends[0].URL)
+	if len(BTC.Backends) > 1 {
+		log.Printf("(btc) using %d REST backends\n", len(BTC.Backends))
+	}
+}
+
+func backend_set_url(url string) {
+	BTC.RestLock.Lock()
+	BTC.RestURL = url
+	BTC.RestLock.Unlock()
+}
+
+func backend_get_url() (url string) {
+	//for anything outside the sync, which is the only thing that changes it
+	BTC.RestLock.Lock()
+	url = BTC.RestURL
+	BTC.RestLock.Unlock()
+	return url
+}
+
+func backend_set_alert(alert string) {
+	BTC.RestLock.Lock()
+	if alert != BTC.Alert && alert != "" {
+		log.Printf("(btc) %s\n", alert)
+	}
+	BTC.Alert = alert
+	BTC.RestLock.Unlock()
+}
+
+func backend_get_alert() (alert string) {
+	BTC.RestLock.Lock()
+	alert = BTC.Alert
+	BTC.RestLock.Unlock()
+	return alert
+}
+
+func backend_get_active() (active int) {
+	active = -1
+	for i := range BTC.Backends {
+		if BTC.Backends[i].URL == BTC.RestURL {
+			active = i
+		}
+	}
+	return active
+}
+
+func backend_select() (active int, err error) {
+	//keep the current backend while it works, otherwise fail over to the first one that does
+	active = backend_get_active()
+	if active != -1 && BTC.Backends[active].Healthy && !BTC.Backends[active].Failed {
+		return active, nil
+	}
+	for _, failed := range []bool{false, true} {
+		for i := range BTC.Backends {
+			if BTC.Backends[i].Healthy && BTC.Backends[i].Failed == failed {
+				if i != active {
+					log.Printf("(btc) failing over to %s\n", BTC.Backends[i].URL)
+					backend_set_url(BTC.Backends[i].URL)
+				}
+				return i, nil
+			}
+		}
+	}
+	return -1, fmt.Errorf("no healthy bitcoin backends")
+}
+
+func backend_get_chains() (chain ChainData, err error) {
+	for i := range BTC.Backends {
+		var b *Backend = &BTC.Backends[i]
+		if b.Chain, err = rest_get_chains(BTC.RestClient, b.URL); err != nil && b.Healthy {
+			log.Printf("(btc) backend %s is down (%s)\n", b.URL, err.Error())
+		} else if err == nil && !b.Healthy {
+			log.Printf("(btc) backend %s is back up\n", b.URL)
+		}
+		b.Healthy = err == nil
+	}
+
+	var active int
+	if active, err = backend_select(); err != nil {
+		backend_set_alert("")
+		return chain, err
+	}
+	chain = BTC.Backends[active].Chain
+
+	//every healthy backend should see the same tip, if one keeps disagreeing its stuck or on another chain
+	var disagree []string
+	for i := range BTC.Backends {
+		var b *Backend = &BTC.Backends[i]
+		if !b.Healthy || b.Chain.TopHash == chain.TopHash {
+			b.Disagree = 0
+			continue
+		}
+		if b.Disagree++; b.Disagree >= BACKEND_ALERT_POLLS {
+			disagree = append(disagree, fmt.Sprintf("%s has %X (%d)", b.URL, b.Chain.TopHash, b.Chain.Height))
+		}
+	}
+	var alert string
+	if len(disagree) != 0 {
+		alert = fmt.Sprintf("backends disagree on tip, %s has %X (%d) but %s", BTC.RestURL, chain.TopHash, chain.Height, strings.Join(disagree, ", "))
+	}
+	backend_set_alert(alert)
+	return chain, nil
+}
+
+func backend_set_failed(failed bool) {
+	if active := backend_get_active(); active != -1 {
+		BTC.Backends[active].Failed = failed
+	}
+}
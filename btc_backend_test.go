@@ -0,0 +1,67 @@
+package main
+
+import (
+	"testing"
+)
+
+func backend_test_add(t *testing.T, chain *MockChain) {
+	//another backend serving its own copy of the chain
+	var server = mock_rest_server(chain)
+	t.Cleanup(server.Close)
+	BTC.Backends = append(BTC.Backends, Backend{URL: server.URL + "/rest", Healthy: true})
+}
+
+func backend_test_alert(t *testing.T, raised bool) {
+	t.Helper()
+	if _, err := backend_get_chains(); err != nil {
+		t.Fatal(err)
+	}
+	var status StatusInfo
+	new(Control).GetStatus(&struct{}{}, &status)
+	if (status.Alert != "") != raised {
+		t.Fatalf("alert is %q, expected raised %t", status.Alert, raised)
+	}
+}
+
+func TestBackendFailover(t *testing.T) {
+	var chain *MockChain = sync_test_start(t, 2)
+	mock_extend(chain, chain.Genesis, 20, 1)
+	BTC.Backends[0].URL = "http://127.0.0.1:1/rest"
+	backend_set_url(BTC.Backends[0].URL)
+	backend_test_add(t, chain)
+
+	btc_sync()
+	sync_test_check(t, chain, 2)
+	if backend_get_url() != BTC.Backends[1].URL || BTC.Backends[0].Healthy {
+		t.Fatalf("synced from %s, expected %s", backend_get_url(), BTC.Backends[1].URL)
+	}
+}
+
+func TestBackendAlert(t *testing.T) {
+	//the mock chains are deterministic, so the second backend has the same blocks until one gets ahead
+	var chain *MockChain = sync_test_start(t, 2)
+	mock_extend(chain, chain.Genesis, 20, 1)
+	var other *MockChain = mock_chain_new()
+	mock_extend(other, other.Genesis, 20, 1)
+	backend_test_add(t, other)
+	backend_test_alert(t, false)
+
+	//seeing each new block a poll later is normal
+	for i := 0; i < BACKEND_ALERT_POLLS*2; i++ {
+		mock_extend(chain, chain.Tip, 1, 1)
+		backend_test_alert(t, false)
+		mock_extend(other, other.Tip, 1, 1)
+		backend_test_alert(t, false)
+	}
+
+	//but not catching up for a few polls is not
+	mock_extend(chain, chain.Tip, 1, 1)
+	for i := 1; i < BACKEND_ALERT_POLLS; i++ {
+		backend_test_alert(t, false)
+	}
+	backend_test_alert(t, true)
+	backend_test_alert(t, true)
+
+	mock_extend(other, other.Tip, 1, 1)
+	backend_test_alert(t, false)
+}
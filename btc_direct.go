@@ -1,12 +1,15 @@
 package main
 
 import (
-	"bufio"
 	"encoding/binary"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
 	"os"
 	"path/filepath"
+
+	"github.com/syndtr/goleveldb/leveldb"
 )
 
 type RawData map[[32]byte]*BlockData
@@ -19,9 +22,13 @@ func direct_parse_block_file(data []byte, blocks *RawData, path string) {
 	}
 	stats, _ := f.Stat()
 	data = data[:stats.Size()]
-	buf := bufio.NewReader(f)
-	buf.Read(data)
+	_, err = io.ReadFull(f, data)
 	f.Close()
+	if err != nil {
+		log.Printf("(direct) cant read file %s (%s)\n", path, err.Error())
+		return
+	}
+	direct_deobfuscate(data, 0)
 
 	var p int = 0
 	var size int
@@ -29,30 +36,44 @@ func direct_parse_block_file(data []byte, blocks *RawData, path string) {
 	for {
 
 		//check for the end of file, otherwise check if the magic bytes are there
-		if p >= len(data) || binary.LittleEndian.Uint32(data[p:p+4]) != COMBInfo.Magic {
+		if p+8 > len(data) || binary.LittleEndian.Uint32(data[p:p+4]) != COMBInfo.Magic {
 			break
 		}
 		p += 4
 		//next 4 bytes is the size of the upcoming block
 		size = int(binary.LittleEndian.Uint32(data[p : p+4]))
 		p += 4
+		if p+size > len(data) {
+			log.Printf("(direct) truncated block at the end of %s\n", path)
+			break
+		}
 
-		//now actually parse the block
+		//now actually parse the block, damaged blocks are skipped (the chain wont trace through them)
 		block := new(BlockData)
-		btc_parse_block(data[p:p+size], block)
-		(*blocks)[block.Hash] = block
+		if err = btc_parse_block(data[p:p+size], block); err != nil {
+			log.Printf("(direct) skipping block in %s (%s)\n", path, err.Error())
+		} else {
+			(*blocks)[block.Hash] = block
+		}
 		p += size
 	}
 }
 
-func direct_trace_chain(blocks *RawData, target [32]byte, history *map[[32]byte][32]byte, length uint64) (block_chain [][32]byte) {
-	//trace back from target to a known block (any block in history)
+func direct_known_history(history *map[[32]byte][32]byte) func(hash [32]byte) bool {
+	return func(hash [32]byte) bool {
+		_, ok := (*history)[hash]
+		return ok
+	}
+}
+
+func direct_trace_chain(blocks *RawData, target [32]byte, known func(hash [32]byte) bool, length uint64) (block_chain [][32]byte) {
+	//trace back from target to a known block (usually any block in history)
 	var hash [32]byte = target
 	for {
 		if block, ok := (*blocks)[hash]; ok {
 			block_chain = append(block_chain, hash)
 			hash = block.Previous
-			if _, ok := (*history)[hash]; ok {
+			if known(hash) {
 				break
 			}
 		} else {
@@ -64,7 +85,7 @@ func direct_trace_chain(blocks *RawData, target [32]byte, history *map[[32]byte]
 	combcore_set_status(fmt.Sprintf("Mining (%.2f%%)...", progress))
 
 	//check if we actually found a known block
-	if _, ok := (*history)[hash]; !ok {
+	if !known(hash) {
 		return nil //nope
 	}
 
@@ -76,7 +97,7 @@ func direct_trace_chain(blocks *RawData, target [32]byte, history *map[[32]byte]
 	return block_chain
 }
 
-func direct_load_trace(blocks *RawData, path string, target [32]byte, history *map[[32]byte][32]byte, length uint64) (chain [][32]byte, err error) {
+func direct_load_trace(blocks *RawData, path string, target [32]byte, known func(hash [32]byte) bool, length uint64) (chain [][32]byte, err error) {
 	var block_data []byte = make([]byte, 128*1024*1024) //blk files are max 128mb
 	var block_files []string
 	if block_files, err = filepath.Glob(path + "/blocks/blk*.dat"); err != nil {
@@ -95,7 +116,7 @@ func direct_load_trace(blocks *RawData, path string, target [32]byte, history *m
 		direct_parse_block_file(block_data, blocks, block_files[b])
 
 		//now see if we have a valid chain loaded (from target to any block in history)
-		chain = direct_trace_chain(blocks, target, history, length)
+		chain = direct_trace_chain(blocks, target, known, length)
 
 		if len(chain) != 0 {
 			break //valid chain found
@@ -104,33 +125,184 @@ func direct_load_trace(blocks *RawData, path string, target [32]byte, history *m
 	return chain, nil
 }
 
-func direct_check_path(path string) (err error) {
+func direct_deobfuscate(data []byte, offset int64) {
+	//newer bitcoin core versions xor the blk files with a key from blocks/xor.dat
+	if BTC.DirectKey == [8]byte{} {
+		return
+	}
+	for i := range data {
+		data[i] ^= BTC.DirectKey[(offset+int64(i))%8]
+	}
+}
+
+func direct_load_key(path string) (key [8]byte, err error) {
+	var data []byte
+	if data, err = ioutil.ReadFile(path + "/xor.dat"); err != nil {
+		if os.IsNotExist(err) {
+			return key, nil //older versions dont obfuscate
+		}
+		return key, err
+	}
+	if len(data) != len(key) {
+		return key, fmt.Errorf("unsupported xor.dat (%d bytes)", len(data))
+	}
+	copy(key[:], data)
+	return key, nil
+}
+
+func direct_check_path(path string) (key [8]byte, err error) {
 	if path == "" {
-		return fmt.Errorf("no path configured")
+		return key, fmt.Errorf("no path configured")
 	}
 	path = path + "/blocks"
 	if _, err = os.Stat(path); err != nil {
-		return err
+		return key, err
+	}
+	if _, err = os.Stat(path + "/index"); err != nil {
+		return key, err
 	}
 	var block_files []string
 	if block_files, err = filepath.Glob(path + "/blk*.dat"); err != nil {
-		return err
+		return key, err
 	}
 	if len(block_files) == 0 {
-		return fmt.Errorf("no block files found")
+		return key, fmt.Errorf("no block files found")
+	}
+
+	if key, err = direct_load_key(path); err != nil {
+		return key, err
+	}
+	if key != [8]byte{} {
+		log.Printf("(direct) block files are obfuscated (key %X)\n", key)
+	} else {
+		log.Printf("(direct) block files are not obfuscated\n")
+	}
+
+	//every block file starts with a block, pruned nodes delete the oldest so check the first one left
+	var magic [4]byte
+	var f *os.File
+	if f, err = os.Open(block_files[0]); err != nil {
+		return key, err
+	}
+	_, err = io.ReadFull(f, magic[:])
+	f.Close()
+	if err != nil {
+		return key, err
+	}
+	for i := range magic {
+		magic[i] ^= key[i]
+	}
+	if binary.LittleEndian.Uint32(magic[:]) != COMBInfo.Magic {
+		return key, fmt.Errorf("block files are not in a supported layout (wrong network or unknown obfuscation)")
 	}
 
 	log.Printf("(direct) found %d block files\n", len(block_files))
+	return key, nil
+}
+
+func direct_index_trace(index *leveldb.DB, path string, target [32]byte, history *map[[32]byte][32]byte, length uint64, blocks *RawData) (chain []BlockLocation, top [][32]byte, err error) {
+	//core only writes its index when it flushes, so the newest blocks are often just in the blk files
+	//those are scanned (newest file first) back to a block the index does have, the rest comes from the index
+	var base [32]byte = target
+	if _, _, err = index_get_block(index, target); err != nil {
+		log.Printf("(direct) %X is not indexed yet, scanning the newest block files\n", target)
+		var in_history = direct_known_history(history)
+		var known = func(hash [32]byte) bool {
+			if in_history(hash) {
+				return true
+			}
+			_, _, err := index_get_block(index, hash)
+			return err == nil
+		}
+		if top, err = direct_load_trace(blocks, path, target, known, length); err != nil {
+			return nil, nil, err
+		}
+		if len(top) == 0 {
+			return nil, nil, fmt.Errorf("cant trace %X back to an indexed block", target)
+		}
+		base = (*blocks)[top[0]].Previous
+	}
+	if chain, err = index_trace_chain(index, base, history, length); err != nil {
+		return nil, nil, err
+	}
+	return chain, top, nil
+}
+
+func direct_index_get_block_range(index *leveldb.DB, path string, chain []BlockLocation, top [][32]byte, blocks *RawData, out chan<- BlockData) (err error) {
+	var files BlockFiles = BlockFiles{Path: path}
+	defer direct_close_files(&files)
+
+	//read every block on the best chain from where the index says it lives (in order), then the unindexed ones from memory
+	var hashes [][32]byte = make([][32]byte, 0, len(chain)+len(top))
+	for _, location := range chain {
+		hashes = append(hashes, location.Hash)
+	}
+	hashes = append(hashes, top...)
+	var indexed HeaderSource = index_header_source(index)
+	var source HeaderSource = HeaderSource{Get: func(hash [32]byte) ([]BlockHeader, error) {
+		if block, ok := (*blocks)[hash]; ok {
+			return []BlockHeader{block.Header}, nil
+		}
+		return indexed.Get(hash)
+	}}
+	if err = pow_check_chain(hashes, source); err != nil {
+		return err
+	}
+
+	for i, location := range chain {
+		var data []byte
+		if data, err = direct_read_block(&files, location); err != nil {
+			return err
+		}
+		block := new(BlockData)
+		if err = btc_parse_block(data, block); err != nil {
+			return err
+		}
+		if block.Hash != location.Hash {
+			return fmt.Errorf("read wrong block %X != %X", block.Hash, location.Hash)
+		}
+
+		var progress float64 = (float64(i) / float64(len(hashes))) * 100.0
+		combcore_set_status(fmt.Sprintf("Mining (%.2f%%)...", progress))
+		out <- *block
+	}
+	for _, hash := range top {
+		out <- *(*blocks)[hash]
+	}
 	return nil
 }
+
 func direct_get_block_range(path string, target [32]byte, history *map[[32]byte][32]byte, length uint64, out chan<- BlockData) (err error) {
 	defer close(out)
 	var blocks RawData = make(RawData)
 	var chain [][32]byte
 
+	//use bitcoin cores block index if we can, so only blocks on the best chain are read
+	if index, err := index_open(path); err != nil {
+		log.Printf("(direct) cant open block index, scanning block files instead (%s)\n", err.Error())
+	} else if locations, top, err := direct_index_trace(index, path, target, history, length, &blocks); err != nil {
+		index.Close()
+		log.Printf("(direct) block index is incomplete, scanning block files instead (%s)\n", err.Error())
+	} else {
+		defer index.Close()
+		return direct_index_get_block_range(index, path, locations, top, &blocks, out)
+	}
+
 	//read the raw block data, tracing the blocks back from the target to a known block (probably a checkpoint)
 	//processed blocks are stored IN MEMORY until a complete/valid chain is found (expect ~1gb of RAM usage)
-	if chain, err = direct_load_trace(&blocks, path, target, history, length); err != nil {
+	if chain, err = direct_load_trace(&blocks, path, target, direct_known_history(history), length); err != nil {
+		return err
+	}
+
+	//headers for the chain are already in memory, anything older (retargets, forks) comes from the configured source
+	var fallback HeaderSource = btc_header_source()
+	var source HeaderSource = HeaderSource{Get: func(hash [32]byte) ([]BlockHeader, error) {
+		if block, ok := blocks[hash]; ok {
+			return []BlockHeader{block.Header}, nil
+		}
+		return fallback.Get(hash)
+	}}
+	if err = pow_check_chain(chain, source); err != nil {
 		return err
 	}
 
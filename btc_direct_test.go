@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func direct_test_obfuscate(t *testing.T, path string, key [8]byte) {
+	//what newer bitcoin core versions write, every blk file xored with the key in blocks/xor.dat
+	if err := ioutil.WriteFile(path+"/blocks/xor.dat", key[:], 0644); err != nil {
+		t.Fatal(err)
+	}
+	files, _ := filepath.Glob(path + "/blocks/blk*.dat")
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := range data {
+			data[i] ^= key[i%8]
+		}
+		if err = ioutil.WriteFile(file, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestDeobfuscate(t *testing.T) {
+	var data []byte = []byte("the quick brown fox jumps over the lazy dog")
+	defer func() { BTC.DirectKey = [8]byte{} }()
+	for _, key := range [][8]byte{{}, {1, 2, 3, 4, 5, 6, 7, 8}, {0xff, 0, 0xff, 0, 0xff, 0, 0xff, 0}} {
+		BTC.DirectKey = key
+		var whole []byte = append([]byte{}, data...)
+		direct_deobfuscate(whole, 0)
+		for i := range whole {
+			if whole[i] != data[i]^key[i%8] {
+				t.Fatalf("key %X: byte %d is %X, expected %X", key, i, whole[i], data[i]^key[i%8])
+			}
+		}
+
+		//reading from the middle of a file has to line up with the key, wherever the read starts
+		for _, offset := range []int{1, 7, 8, 13} {
+			var part []byte = append([]byte{}, data[offset:]...)
+			direct_deobfuscate(part, int64(offset))
+			if !bytes.Equal(part, whole[offset:]) {
+				t.Fatalf("key %X: read at %d gave %X, expected %X", key, offset, part, whole[offset:])
+			}
+		}
+
+		direct_deobfuscate(whole, 0)
+		if !bytes.Equal(whole, data) {
+			t.Fatalf("key %X: xoring twice gave %q", key, whole)
+		}
+	}
+}
+
+func TestLoadKey(t *testing.T) {
+	for _, test := range []struct {
+		data []byte //nil for no xor.dat
+		key  [8]byte
+		ok   bool
+	}{
+		{nil, [8]byte{}, true},
+		{[]byte{1, 2, 3, 4, 5, 6, 7, 8}, [8]byte{1, 2, 3, 4, 5, 6, 7, 8}, true},
+		{make([]byte, 8), [8]byte{}, true},
+		{[]byte{}, [8]byte{}, false},
+		{[]byte{1, 2, 3, 4, 5, 6, 7}, [8]byte{}, false},
+		{[]byte{1, 2, 3, 4, 5, 6, 7, 8, 9}, [8]byte{}, false},
+	} {
+		var path string = t.TempDir()
+		if test.data != nil {
+			if err := ioutil.WriteFile(path+"/xor.dat", test.data, 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		key, err := direct_load_key(path)
+		if (err == nil) != test.ok || (test.ok && key != test.key) {
+			t.Fatalf("xor.dat %X gave %X (%v), expected %X", test.data, key, err, test.key)
+		}
+	}
+}
+
+func TestCheckPath(t *testing.T) {
+	var chain *MockChain = sync_test_start(t, 2)
+	var a [][32]byte = mock_extend(chain, chain.Genesis, 5, 1)
+	var key [8]byte = [8]byte{0x11, 0x22, 0x33, 0x44, 0x55, 0x66, 0x77, 0x88}
+	var layout = func(index bool, obfuscated bool, first string) (path string) {
+		path = mock_write_block_files(t, chain, a)
+		if index {
+			os.Mkdir(path+"/blocks/index", 0755)
+		}
+		if obfuscated {
+			direct_test_obfuscate(t, path, key)
+		}
+		if first == "" {
+			os.Remove(path + "/blocks/blk00000.dat")
+		} else if first != "blk00000.dat" {
+			os.Rename(path+"/blocks/blk00000.dat", path+"/blocks/"+first)
+		}
+		return path
+	}
+	var wrong string = layout(true, false, "blk00000.dat")
+	data, _ := ioutil.ReadFile(wrong + "/blocks/blk00000.dat")
+	data[0] ^= 1
+	ioutil.WriteFile(wrong+"/blocks/blk00000.dat", data, 0644)
+
+	for _, test := range []struct {
+		name string
+		path string
+		key  [8]byte
+		ok   bool
+	}{
+		{"plain", layout(true, false, "blk00000.dat"), [8]byte{}, true},
+		{"obfuscated", layout(true, true, "blk00000.dat"), key, true},
+		{"pruned", layout(true, false, "blk00003.dat"), [8]byte{}, true},
+		{"pruned and obfuscated", layout(true, true, "blk00003.dat"), key, true},
+		{"no path", "", [8]byte{}, false},
+		{"no blocks", t.TempDir(), [8]byte{}, false},
+		{"no index", layout(false, false, "blk00000.dat"), [8]byte{}, false},
+		{"no block files", layout(true, false, ""), [8]byte{}, false},
+		{"wrong magic", wrong, [8]byte{}, false},
+	} {
+		got, err := direct_check_path(test.path)
+		if (err == nil) != test.ok || (test.ok && got != test.key) {
+			t.Fatalf("%s: got key %X (%v), expected %X", test.name, got, err, test.key)
+		}
+	}
+}
+
+func TestSyncObfuscated(t *testing.T) {
+	//the whole offline sync from xored blk files
+	var chain *MockChain = sync_test_start(t, 2)
+	var a [][32]byte = mock_extend(chain, chain.Genesis, 20, 1)
+	var path string = mock_write_block_files(t, chain, append([][32]byte{chain.Genesis}, a...))
+	os.Mkdir(path+"/blocks/index", 0755)
+	direct_test_obfuscate(t, path, [8]byte{9, 8, 7, 6, 5, 4, 3, 2})
+
+	key, err := direct_check_path(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	BTC.Backends[0].URL = "http://127.0.0.1:1/rest"
+	BTC.RestURL = BTC.Backends[0].URL
+	BTC.DirectPath, BTC.DirectKey = path, key
+	BTC.Offline = true
+	OfflineInfo.Headers = nil
+	t.Cleanup(func() {
+		BTC.DirectPath, BTC.DirectKey = "", [8]byte{}
+		BTC.Offline = false
+	})
+
+	btc_sync()
+	sync_test_check(t, chain, 2)
+}
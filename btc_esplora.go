@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+//block source for esplora/electrs style http indexers, see https://github.com/Blockstream/esplora/blob/master/API.md
+
+func esplora_call(client *http.Client, url string) (data []byte, err error) {
+	response, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	data, err = ioutil.ReadAll(response.Body)
+	response.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("esplora returned %s (%s)", response.Status, strings.TrimSpace(string(data)))
+	}
+	return data, nil
+}
+
+func esplora_get_chains(client *http.Client, url string) (chain ChainData, err error) {
+	var data []byte
+	if data, err = esplora_call(client, fmt.Sprintf("%s/blocks/tip/hash", url)); err != nil {
+		return chain, err
+	}
+	if chain.TopHash, err = parse_hex(strings.TrimSpace(string(data))); err != nil {
+		return chain, err
+	}
+	if data, err = esplora_call(client, fmt.Sprintf("%s/blocks/tip/height", url)); err != nil {
+		return chain, err
+	}
+	if chain.Height, err = strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64); err != nil {
+		return chain, fmt.Errorf("height is gibberish (%s) got (%s)", err.Error(), string(data))
+	}
+	chain.KnownHeight = chain.Height
+	return chain, nil
+}
+
+func esplora_get_header(client *http.Client, url string, hash [32]byte) (header BlockHeader, err error) {
+	var data []byte
+	if data, err = esplora_call(client, fmt.Sprintf("%s/block/%x/header", url, hash)); err != nil {
+		return header, err
+	}
+	var raw string = strings.ToUpper(strings.TrimSpace(string(data)))
+	if !checkHEX(raw, 80) {
+		return header, fmt.Errorf("header is gibberish got (%s)", raw)
+	}
+	if header, err = btc_parse_header(hex2byte([]byte(raw))); err != nil {
+		return header, err
+	}
+
+	//make sure the indexer gave us the header we asked for
+	if header.Hash != hash {
+		return header, fmt.Errorf("recieved wrong header %X != %X", header.Hash, hash)
+	}
+	return header, nil
+}
+
+func esplora_header_source(client *http.Client, url string) HeaderSource {
+	return HeaderSource{Get: func(hash [32]byte) ([]BlockHeader, error) {
+		header, err := esplora_get_header(client, url, hash)
+		return []BlockHeader{header}, err
+	}}
+}
+
+func esplora_trace_chain(client *http.Client, url string, target [32]byte, history *map[[32]byte][32]byte, length uint64) (chain [][32]byte, err error) {
+	//keep tracing the chain back from the tip until we find a block thats known (in history)
+	var hash [32]byte = target
+	for {
+		if _, ok := (*history)[hash]; ok {
+			break
+		}
+		chain = append(chain, hash)
+		var header BlockHeader
+		if header, err = esplora_get_header(client, url, hash); err != nil {
+			return nil, err
+		}
+		pow_cache_header(header)
+		hash = header.Previous
+
+		var progress float64 = (float64(len(chain)) / float64(length)) * 100.0
+		combcore_set_status(fmt.Sprintf("Tracing (%.2f%%)...", progress))
+	}
+
+	//reverse the chain so older blocks are mined first
+	for i, j := 0, len(chain)-1; i < j; i, j = i+1, j-1 {
+		chain[i], chain[j] = chain[j], chain[i]
+	}
+	return chain, nil
+}
+
+func esplora_get_block(client *http.Client, url string, hash [32]byte) (block BlockData, err error) {
+	var data []byte
+	if data, err = esplora_call(client, fmt.Sprintf("%s/block/%x/raw", url, hash)); err != nil {
+		return block, err
+	}
+	if err = btc_parse_block(data, &block); err != nil {
+		return block, err
+	}
+	if block.Hash != hash {
+		return block, fmt.Errorf("recieved wrong block %X != %X", block.Hash, hash)
+	}
+	return block, nil
+}
+
+func esplora_get_block_range(client *http.Client, url string, target [32]byte, history *map[[32]byte][32]byte, length uint64, out chan<- BlockData) (err error) {
+	defer close(out)
+	var chain [][32]byte
+
+	if chain, err = esplora_trace_chain(client, url, target, history, length); err != nil {
+		return err
+	}
+	if err = pow_check_chain(chain, esplora_header_source(client, url)); err != nil {
+		return err
+	}
+
+	return btc_fetch_ordered(chain, int(*btc_rest_workers), length, out, func(hash [32]byte) (BlockData, error) {
+		return esplora_get_block(client, url, hash)
+	})
+}
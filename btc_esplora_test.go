@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+//a fake esplora indexer serving a mock chain, it can be told to hand out the wrong header or block for a hash
+
+type MockEsplora struct {
+	Chain   *MockChain
+	Headers map[[32]byte][32]byte //answer header requests for the key with the header of the value
+	Raw     map[[32]byte][32]byte //same for raw blocks
+}
+
+func mock_esplora_server(t *testing.T, esplora *MockEsplora) string {
+	var chain *MockChain = esplora.Chain
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		chain.Lock.Lock()
+		var best [][32]byte = mock_best_chain(chain)
+		var tip [32]byte = chain.Tip
+		chain.Lock.Unlock()
+		var path []string = strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+		switch {
+		case r.URL.Path == "/blocks/tip/hash":
+			fmt.Fprintf(w, "%x\n", tip)
+		case r.URL.Path == "/blocks/tip/height":
+			fmt.Fprintf(w, "%d\n", len(best)-1)
+		case len(path) == 3 && path[0] == "block":
+			hash, err := parse_hex(path[1])
+			if err != nil {
+				http.Error(w, "Invalid hex string", http.StatusBadRequest)
+				return
+			}
+			chain.Lock.Lock()
+			var swaps map[[32]byte][32]byte = esplora.Headers
+			if path[2] == "raw" {
+				swaps = esplora.Raw
+			}
+			if swap, ok := swaps[hash]; ok {
+				hash = swap
+			}
+			block, ok := chain.Blocks[hash]
+			var height int = int(chain.Height[hash])
+			chain.Lock.Unlock()
+			switch {
+			case ok && path[2] == "header":
+				fmt.Fprint(w, hex.EncodeToString(block[:80]))
+				return
+			case ok && path[2] == "raw":
+				//older blocks take longer, so the requests in flight finish out of order
+				time.Sleep(time.Duration(len(best)-height) * time.Millisecond)
+				w.Write(block)
+				return
+			}
+			http.Error(w, "Block not found", http.StatusNotFound)
+		default:
+			http.Error(w, "not found", http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server.URL
+}
+
+func esplora_test_start(t *testing.T) (chain *MockChain, esplora *MockEsplora) {
+	chain = sync_test_start(t, 2)
+	esplora = &MockEsplora{Chain: chain, Headers: make(map[[32]byte][32]byte), Raw: make(map[[32]byte][32]byte)}
+	BTC.EsploraURL = mock_esplora_server(t, esplora)
+	var workers uint = *btc_rest_workers
+	*btc_rest_workers = 4
+	t.Cleanup(func() {
+		BTC.EsploraURL = ""
+		*btc_rest_workers = workers
+	})
+	return chain, esplora
+}
+
+func esplora_test_range(target [32]byte) (hashes [][32]byte, err error) {
+	var out chan BlockData = make(chan BlockData)
+	var done chan error = make(chan error, 1)
+	go func() {
+		done <- esplora_get_block_range(BTC.RestClient, BTC.EsploraURL, target, &COMBInfo.Chain, 0, out)
+	}()
+	for block := range out {
+		hashes = append(hashes, block.Hash)
+	}
+	return hashes, <-done
+}
+
+func TestEsploraChains(t *testing.T) {
+	var chain, _ = esplora_test_start(t)
+	mock_extend(chain, chain.Genesis, 12, 1)
+
+	result, err := esplora_get_chains(BTC.RestClient, BTC.EsploraURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.TopHash != chain.Tip || result.Height != 12 || result.KnownHeight != 12 {
+		t.Fatalf("got %X at %d (known %d), expected %X at 12", result.TopHash, result.Height, result.KnownHeight, chain.Tip)
+	}
+}
+
+func TestEsploraRange(t *testing.T) {
+	//blocks come back slowest first, but have to be handed on in chain order
+	var chain, _ = esplora_test_start(t)
+	var a [][32]byte = mock_extend(chain, chain.Genesis, 20, 1)
+
+	hashes, err := esplora_test_range(chain.Tip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hashes) != len(a) {
+		t.Fatalf("got %d blocks, expected %d", len(hashes), len(a))
+	}
+	for i := range a {
+		if hashes[i] != a[i] {
+			t.Fatalf("block %d is %X, expected %X", i, hashes[i], a[i])
+		}
+	}
+
+	//and the whole sync on top of it
+	btc_sync()
+	sync_test_check(t, chain, 2)
+}
+
+func TestEsploraMismatch(t *testing.T) {
+	var chain, esplora = esplora_test_start(t)
+	var a [][32]byte = mock_extend(chain, chain.Genesis, 10, 1)
+
+	//a header for another block is caught while tracing, before any block is sent
+	esplora.Headers[a[5]] = a[4]
+	if hashes, err := esplora_test_range(chain.Tip); err == nil || len(hashes) != 0 {
+		t.Fatalf("got %d blocks (%v) with a wrong header", len(hashes), err)
+	}
+	delete(esplora.Headers, a[5])
+
+	//a raw block for another hash stops the range right before it
+	esplora.Raw[a[5]] = a[4]
+	hashes, err := esplora_test_range(chain.Tip)
+	if err == nil {
+		t.Fatal("wrong block was accepted")
+	}
+	if len(hashes) != 5 || hashes[4] != a[4] {
+		t.Fatalf("got %d blocks before the wrong one, expected 5", len(hashes))
+	}
+	delete(esplora.Raw, a[5])
+
+	btc_sync()
+	sync_test_check(t, chain, 2)
+}
@@ -0,0 +1,13 @@
+//go:build go1.18
+
+package main
+
+import "testing"
+
+//seeded from testdata/fuzz/FuzzParseBlock, run with go test -fuzz FuzzParseBlock
+
+func FuzzParseBlock(f *testing.F) {
+	f.Fuzz(func(t *testing.T, data []byte) {
+		parse_test_check(t, data)
+	})
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+)
+
+//bitcoin cores block index (blocks/index), see CDiskBlockIndex in bitcoin/src/chain.h
+
+const INDEX_BLOCK_HAVE_DATA = 8
+const INDEX_BLOCK_HAVE_UNDO = 16
+
+type BlockLocation struct {
+	Hash   [32]byte
+	Height uint64
+	File   uint64
+	Pos    uint64 //offset of the block in the blk file (after magic and size)
+}
+
+type BlockFiles struct {
+	Path   string
+	Number uint64
+	File   *os.File
+}
+
+func index_parse_varint(data []byte) (value uint64, advance int, err error) {
+	//bitcoin cores internal varint (not the compact size used in blocks), see VARINT in bitcoin/src/serialize.h
+	for advance < len(data) {
+		var b byte = data[advance]
+		advance++
+		value = (value << 7) | uint64(b&0x7f)
+		if b&0x80 == 0 {
+			return value, advance, nil
+		}
+		value++
+	}
+	return 0, 0, fmt.Errorf("varint is truncated")
+}
+
+func index_open(path string) (index *leveldb.DB, err error) {
+	var options opt.Options
+	options.ReadOnly = true
+	options.ErrorIfMissing = true
+	return leveldb.OpenFile(path+"/blocks/index", &options)
+}
+
+func index_get_block(index *leveldb.DB, hash [32]byte) (location BlockLocation, header BlockHeader, err error) {
+	var key [33]byte
+	var value []byte
+	var internal [32]byte = swap_endian(hash)
+	key[0] = 'b'
+	copy(key[1:], internal[:])
+	if value, err = index.Get(key[:], nil); err != nil {
+		return location, header, fmt.Errorf("block %X not in index (%s)", hash, err.Error())
+	}
+
+	var fields [4]uint64 //client version, height, status, tx count
+	for i := range fields {
+		var adv int
+		if fields[i], adv, err = index_parse_varint(value); err != nil {
+			return location, header, err
+		}
+		value = value[adv:]
+	}
+	var status uint64 = fields[2]
+	if status&INDEX_BLOCK_HAVE_DATA == 0 {
+		return location, header, fmt.Errorf("block %X is not on disk (pruned?)", hash)
+	}
+
+	var adv int
+	if location.File, adv, err = index_parse_varint(value); err != nil {
+		return location, header, err
+	}
+	value = value[adv:]
+	if location.Pos, adv, err = index_parse_varint(value); err != nil {
+		return location, header, err
+	}
+	value = value[adv:]
+	if status&INDEX_BLOCK_HAVE_UNDO != 0 {
+		if _, adv, err = index_parse_varint(value); err != nil {
+			return location, header, err
+		}
+		value = value[adv:]
+	}
+	if len(value) < 80 {
+		return location, header, fmt.Errorf("block %X has a truncated header", hash)
+	}
+
+	//sanity check the header actually belongs to the hash
+	if header, err = btc_parse_header(value); err != nil {
+		return location, header, err
+	}
+	if header.Hash != hash {
+		return location, header, fmt.Errorf("block %X has the wrong header", hash)
+	}
+
+	location.Hash = hash
+	location.Height = fields[1]
+	return location, header, nil
+}
+
+func index_trace_chain(index *leveldb.DB, target [32]byte, history *map[[32]byte][32]byte, length uint64) (chain []BlockLocation, err error) {
+	//walk back from the target to a known block using only the index, nothing is read from the blk files
+	var hash [32]byte = target
+	for {
+		if _, ok := (*history)[hash]; ok {
+			break
+		}
+		var location BlockLocation
+		var header BlockHeader
+		if location, header, err = index_get_block(index, hash); err != nil {
+			return nil, err
+		}
+		pow_cache_header(header)
+		chain = append(chain, location)
+		hash = header.Previous
+
+		if len(chain)%1000 == 0 {
+			var progress float64 = (float64(len(chain)) / float64(length)) * 100.0
+			combcore_set_status(fmt.Sprintf("Tracing (%.2f%%)...", progress))
+		}
+	}
+
+	//reverse the chain so older blocks are mined first
+	for i, j := 0, len(chain)-1; i < j; i, j = i+1, j-1 {
+		chain[i], chain[j] = chain[j], chain[i]
+	}
+	return chain, nil
+}
+
+func index_header_source(index *leveldb.DB) HeaderSource {
+	return HeaderSource{Get: func(hash [32]byte) ([]BlockHeader, error) {
+		_, header, err := index_get_block(index, hash)
+		return []BlockHeader{header}, err
+	}}
+}
+
+func direct_read_block(files *BlockFiles, location BlockLocation) (data []byte, err error) {
+	if files.File == nil || files.Number != location.File {
+		if files.File != nil {
+			files.File.Close()
+		}
+		if files.File, err = os.Open(fmt.Sprintf("%s/blocks/blk%05d.dat", files.Path, location.File)); err != nil {
+			files.File = nil
+			return nil, err
+		}
+		files.Number = location.File
+	}
+	if location.Pos < 8 {
+		return nil, fmt.Errorf("block %X has a bad position", location.Hash)
+	}
+
+	var header [8]byte //magic(4),size(4)
+	if _, err = files.File.ReadAt(header[:], int64(location.Pos)-8); err != nil {
+		return nil, err
+	}
+	direct_deobfuscate(header[:], int64(location.Pos)-8)
+	if binary.LittleEndian.Uint32(header[0:4]) != COMBInfo.Magic {
+		return nil, fmt.Errorf("block %X is missing magic bytes", location.Hash)
+	}
+	var size uint32 = binary.LittleEndian.Uint32(header[4:8])
+	if size > 128*1024*1024 {
+		return nil, fmt.Errorf("block %X is too large (%d bytes)", location.Hash, size)
+	}
+	data = make([]byte, size)
+	if _, err = files.File.ReadAt(data, int64(location.Pos)); err != nil {
+		return nil, err
+	}
+	direct_deobfuscate(data, int64(location.Pos))
+	return data, nil
+}
+
+func direct_close_files(files *BlockFiles) {
+	if files.File != nil {
+		files.File.Close()
+		files.File = nil
+	}
+}
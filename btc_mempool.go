@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+//watches bitcoin cores mempool over REST for commits that are not mined yet
+
+const MEMPOOL_POLL_INTERVAL = 10 * time.Second
+const MEMPOOL_MAX_FETCHES = 1000 //new transactions fetched per poll, a full mempool is picked up over a few polls
+
+var MempoolInfo struct {
+	Lock    sync.Mutex
+	Txs     map[[32]byte][][32]byte //txid -> commits
+	Commits map[[32]byte][32]byte   //commit -> txid
+	Failed  map[[32]byte]struct{}   //txids that couldnt be fetched, not asked for again while they stay in the mempool
+}
+
+func mempool_get_contents(client *http.Client, url string) (txids [][32]byte, err error) {
+	var raw_json json.RawMessage
+	var contents map[string]json.RawMessage
+	if raw_json, err = btc_rest_call(client, fmt.Sprintf("%s/mempool/contents.json", url)); err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(raw_json, &contents); err != nil {
+		return nil, fmt.Errorf("mempool is gibberish (%s)", err.Error())
+	}
+	for id := range contents {
+		var txid [32]byte
+		if txid, err = parse_hex(id); err != nil {
+			return nil, err
+		}
+		txids = append(txids, txid)
+	}
+	return txids, nil
+}
+
+func mempool_get_commits(client *http.Client, url string, txid [32]byte) (commits [][32]byte, err error) {
+	var raw_data []byte
+	if raw_data, err = btc_rest_call(client, fmt.Sprintf("%s/tx/%x.bin", url, txid)); err != nil {
+		return nil, err
+	}
+	//same rule as mined blocks, every P2WSH output is a commit
+	if _, commits, err = btc_parse_transaction(raw_data, nil); err != nil {
+		return nil, fmt.Errorf("tx %X malformed (%s)", txid, err.Error())
+	}
+	return commits, nil
+}
+
+func mempool_fetch(client *http.Client, url string, txids [][32]byte) (txs map[[32]byte][][32]byte, failed map[[32]byte]struct{}) {
+	//up to btc_rest_workers requests in flight, a failure only loses that transaction
+	var lock sync.Mutex
+	var wait sync.WaitGroup
+	var queue chan [32]byte = make(chan [32]byte)
+	var workers int = int(*btc_rest_workers)
+	if workers < 1 {
+		workers = 1
+	}
+	txs = make(map[[32]byte][][32]byte)
+	failed = make(map[[32]byte]struct{})
+	for i := 0; i < workers; i++ {
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			for txid := range queue {
+				commits, err := mempool_get_commits(client, url, txid)
+				lock.Lock()
+				if err != nil {
+					failed[txid] = struct{}{} //probably mined or evicted since we asked
+				} else {
+					txs[txid] = commits
+				}
+				lock.Unlock()
+			}
+		}()
+	}
+	for _, txid := range txids {
+		queue <- txid
+	}
+	close(queue)
+	wait.Wait()
+	return txs, failed
+}
+
+func mempool_update(client *http.Client, url string) (err error) {
+	var txids [][32]byte
+	if txids, err = mempool_get_contents(client, url); err != nil {
+		return err
+	}
+
+	//only new transactions are fetched, anything that left the mempool (mined or evicted) is dropped
+	var txs map[[32]byte][][32]byte = make(map[[32]byte][][32]byte)
+	var failed map[[32]byte]struct{} = make(map[[32]byte]struct{})
+	var fetch [][32]byte
+	var waiting int
+	MempoolInfo.Lock.Lock()
+	for _, txid := range txids {
+		if commits, ok := MempoolInfo.Txs[txid]; ok {
+			txs[txid] = commits
+		} else if _, ok := MempoolInfo.Failed[txid]; ok {
+			failed[txid] = struct{}{}
+		} else if len(fetch) < MEMPOOL_MAX_FETCHES {
+			fetch = append(fetch, txid)
+		} else {
+			waiting++
+		}
+	}
+	MempoolInfo.Lock.Unlock()
+
+	fetched, fetch_failed := mempool_fetch(client, url, fetch)
+	for txid, c := range fetched {
+		txs[txid] = c
+	}
+	for txid := range fetch_failed {
+		failed[txid] = struct{}{}
+	}
+	if waiting != 0 {
+		log.Printf("(mempool) %d transactions left for the next poll\n", waiting)
+	}
+
+	var commits map[[32]byte][32]byte = make(map[[32]byte][32]byte)
+	for txid, c := range txs {
+		for _, commit := range c {
+			commits[commit] = txid
+		}
+	}
+
+	MempoolInfo.Lock.Lock()
+	MempoolInfo.Txs = txs
+	MempoolInfo.Commits = commits
+	MempoolInfo.Failed = failed
+	MempoolInfo.Lock.Unlock()
+	return nil
+}
+
+func mempool_watch(client *http.Client) {
+	for {
+		//follow the active backend if it fails over
+		if err := mempool_update(client, backend_get_url()); err != nil {
+			log.Printf("(mempool) update failed (%s)\n", err.Error())
+		}
+		time.Sleep(MEMPOOL_POLL_INTERVAL)
+	}
+}
+
+func mempool_get_commit(commit [32]byte) (txid [32]byte, ok bool) {
+	MempoolInfo.Lock.Lock()
+	txid, ok = MempoolInfo.Commits[commit]
+	MempoolInfo.Lock.Unlock()
+	return txid, ok
+}
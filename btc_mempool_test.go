@@ -0,0 +1,83 @@
+package main
+
+import (
+	"crypto/sha256"
+	"net/http"
+	"testing"
+)
+
+func mempool_test_add(chain *MockChain, raw []byte) (txid [32]byte) {
+	txid = sha256.Sum256(raw)
+	chain.Lock.Lock()
+	chain.Mempool[txid] = raw
+	chain.Lock.Unlock()
+	return txid
+}
+
+func mempool_test_gets(chain *MockChain) (gets int) {
+	chain.Lock.Lock()
+	gets, chain.TxGets = chain.TxGets, 0
+	chain.Lock.Unlock()
+	return gets
+}
+
+func mempool_test_update(t *testing.T, url string) {
+	t.Helper()
+	if err := mempool_update(&http.Client{}, url); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMempool(t *testing.T) {
+	COMBInfo.Network = "regtest"
+	var chain *MockChain = mock_chain_new()
+	var server = mock_rest_server(chain)
+	defer server.Close()
+	var url string = server.URL + "/rest"
+	MempoolInfo.Txs, MempoolInfo.Failed = nil, nil
+
+	//more new transactions than one poll fetches, and one that cant be parsed
+	var commits [][32]byte
+	var txids [][32]byte
+	for i := 0; i < MEMPOOL_MAX_FETCHES+10; i++ {
+		var commit [32]byte = mock_commit(9, uint64(i), 0)
+		commits = append(commits, commit)
+		txids = append(txids, mempool_test_add(chain, mock_transaction([][32]byte{commit})))
+	}
+	var bad [32]byte = mempool_test_add(chain, []byte{1, 2, 3})
+
+	mempool_test_update(t, url)
+	if gets := mempool_test_gets(chain); gets != MEMPOOL_MAX_FETCHES {
+		t.Fatalf("fetched %d transactions in one poll, expected %d", gets, MEMPOOL_MAX_FETCHES)
+	}
+	mempool_test_update(t, url)
+	if gets := mempool_test_gets(chain); gets != 11 {
+		t.Fatalf("fetched %d transactions in the second poll, expected 11", gets)
+	}
+	for i, commit := range commits {
+		if txid, ok := mempool_get_commit(commit); !ok || txid != txids[i] {
+			t.Fatalf("commit %d pending in %X (%t), expected %X", i, txid, ok, txids[i])
+		}
+	}
+
+	//known and failed transactions are not fetched again
+	mempool_test_update(t, url)
+	if gets := mempool_test_gets(chain); gets != 0 {
+		t.Fatalf("fetched %d known transactions", gets)
+	}
+
+	//once mined they are dropped, failed ones too
+	chain.Lock.Lock()
+	delete(chain.Mempool, txids[0])
+	delete(chain.Mempool, bad)
+	chain.Lock.Unlock()
+	mempool_test_update(t, url)
+	if _, ok := mempool_get_commit(commits[0]); ok {
+		t.Fatal("mined commit is still pending")
+	}
+	MempoolInfo.Lock.Lock()
+	defer MempoolInfo.Lock.Unlock()
+	if _, ok := MempoolInfo.Failed[bad]; ok || len(MempoolInfo.Txs) != len(txids)-1 {
+		t.Fatalf("%d transactions and %d failed left", len(MempoolInfo.Txs), len(MempoolInfo.Failed))
+	}
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+//synthetic bitcoin chains served through a fake of bitcoin cores REST interface
+
+const MOCK_BITS = 0x207fffff //regtest difficulty, about two hashes per block
+
+type MockChain struct {
+	Lock    sync.Mutex
+	Genesis [32]byte
+	Tip     [32]byte
+	Blocks  map[[32]byte][]byte
+	Headers map[[32]byte]BlockHeader
+	Commits map[[32]byte][][32]byte
+	Height  map[[32]byte]uint64
+	Mempool map[[32]byte][]byte //txid -> raw tx
+	TxGets  int                 //mempool transactions fetched
+}
+
+func mock_chain_new() (chain *MockChain) {
+	chain = &MockChain{
+		Blocks:  make(map[[32]byte][]byte),
+		Headers: make(map[[32]byte]BlockHeader),
+		Commits: make(map[[32]byte][][32]byte),
+		Height:  make(map[[32]byte]uint64),
+		Mempool: make(map[[32]byte][]byte),
+	}
+	chain.Genesis = mock_mine(chain, empty, nil)
+	chain.Tip = chain.Genesis
+	return chain
+}
+
+func mock_commit(tag byte, height uint64, n int) (commit [32]byte) {
+	//deterministic but unique per branch, height and output
+	var data [10]byte
+	data[0] = tag
+	binary.BigEndian.PutUint64(data[1:9], height)
+	data[9] = byte(n)
+	return sha256.Sum256(data[:])
+}
+
+func mock_transaction(commits [][32]byte) (tx []byte) {
+	tx = append(tx, 1, 0, 0, 0) //version
+	tx = append(tx, 1)          //vin count
+	tx = append(tx, make([]byte, 32)...)
+	tx = append(tx, 0xff, 0xff, 0xff, 0xff) //coinbase prevout
+	tx = append(tx, 2, 0x51, 0x51)          //script
+	tx = append(tx, 0xff, 0xff, 0xff, 0xff) //sequence
+	tx = append(tx, byte(len(commits)))
+	for _, c := range commits {
+		tx = append(tx, make([]byte, 8)...) //value
+		tx = append(tx, 34, 0x00, 0x20)     //P2WSH
+		tx = append(tx, c[:]...)
+	}
+	tx = append(tx, 0, 0, 0, 0) //locktime
+	return tx
+}
+
+func mock_mine(chain *MockChain, parent [32]byte, commits [][32]byte) (hash [32]byte) {
+	var header [80]byte
+	var time uint32 = 1600000000
+	if previous, ok := chain.Headers[parent]; ok {
+		time = previous.Time + POW_TARGET_SPACING
+	}
+	var previous [32]byte = swap_endian(parent)
+	var tx []byte = mock_transaction(commits)
+	var root [32]byte = sha256.Sum256(tx) //single tx, so the merkle root is its txid
+	root = sha256.Sum256(root[:])
+	binary.LittleEndian.PutUint32(header[0:4], 1)
+	copy(header[4:36], previous[:])
+	copy(header[36:68], root[:])
+	binary.LittleEndian.PutUint32(header[68:72], time)
+	binary.LittleEndian.PutUint32(header[72:76], MOCK_BITS)
+
+	var parsed BlockHeader
+	for nonce := uint32(0); ; nonce++ {
+		binary.LittleEndian.PutUint32(header[76:80], nonce)
+		parsed, _ = btc_parse_header(header[:])
+		if pow_check_header(parsed) == nil {
+			break
+		}
+	}
+
+	var raw []byte = append(header[:], 1)
+	raw = append(raw, tx...)
+
+	hash = parsed.Hash
+	chain.Blocks[hash] = raw
+	chain.Headers[hash] = parsed
+	chain.Commits[hash] = commits
+	if parent != empty {
+		chain.Height[hash] = chain.Height[parent] + 1
+	}
+	return hash
+}
+
+func mock_extend(chain *MockChain, parent [32]byte, count int, tag byte) (hashes [][32]byte) {
+	//mine count blocks on parent, each with a few commits, and make the last one the tip
+	chain.Lock.Lock()
+	defer chain.Lock.Unlock()
+	for i := 0; i < count; i++ {
+		var height uint64 = chain.Height[parent] + 1
+		var commits [][32]byte
+		for n := 0; n < int(height%3); n++ {
+			commits = append(commits, mock_commit(tag, height, n))
+		}
+		parent = mock_mine(chain, parent, commits)
+		hashes = append(hashes, parent)
+	}
+	chain.Tip = parent
+	return hashes
+}
+
+func mock_set_tip(chain *MockChain, tip [32]byte) {
+	chain.Lock.Lock()
+	chain.Tip = tip
+	chain.Lock.Unlock()
+}
+
+func mock_best_chain(chain *MockChain) (hashes [][32]byte) {
+	//genesis first, tip last
+	for hash := chain.Tip; hash != empty; hash = chain.Headers[hash].Previous {
+		hashes = append([][32]byte{hash}, hashes...)
+	}
+	return hashes
+}
+
+func mock_rest_server(chain *MockChain) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		chain.Lock.Lock()
+		defer chain.Lock.Unlock()
+		var best [][32]byte = mock_best_chain(chain)
+		var path []string = strings.Split(strings.TrimPrefix(r.URL.Path, "/rest/"), "/")
+
+		switch {
+		case len(path) == 1 && path[0] == "chaininfo.json":
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"blocks":        chain.Height[chain.Tip],
+				"headers":       chain.Height[chain.Tip],
+				"bestblockhash": fmt.Sprintf("%x", chain.Tip),
+			})
+
+		case len(path) == 2 && path[0] == "blockhashbyheight":
+			height, err := strconv.ParseUint(strings.TrimSuffix(path[1], ".bin"), 10, 64)
+			if err != nil || height >= uint64(len(best)) {
+				http.Error(w, "Block height out of range", http.StatusNotFound)
+				return
+			}
+			var hash [32]byte = swap_endian(best[height])
+			w.Write(hash[:])
+
+		case len(path) == 3 && path[0] == "headers":
+			//like core, only headers on the best chain are followed
+			count, _ := strconv.Atoi(path[1])
+			hash, err := parse_hex(strings.TrimSuffix(path[2], ".bin"))
+			raw, ok := chain.Blocks[hash]
+			if err != nil || !ok {
+				http.Error(w, "not found", http.StatusNotFound)
+				return
+			}
+			w.Write(raw[0:80])
+			var height uint64 = chain.Height[hash]
+			if height >= uint64(len(best)) || best[height] != hash {
+				return
+			}
+			for h := height + 1; h < uint64(len(best)) && h < height+uint64(count); h++ {
+				w.Write(chain.Blocks[best[h]][0:80])
+			}
+
+		case len(path) == 2 && path[0] == "mempool" && path[1] == "contents.json":
+			var contents map[string]interface{} = make(map[string]interface{})
+			for txid := range chain.Mempool {
+				contents[fmt.Sprintf("%x", txid)] = map[string]interface{}{}
+			}
+			json.NewEncoder(w).Encode(contents)
+
+		case len(path) == 2 && path[0] == "tx":
+			chain.TxGets++
+			txid, err := parse_hex(strings.TrimSuffix(path[1], ".bin"))
+			raw, ok := chain.Mempool[txid]
+			if err != nil || !ok {
+				http.Error(w, "not found", http.StatusNotFound)
+				return
+			}
+			w.Write(raw)
+
+		case len(path) == 2 && path[0] == "block":
+			hash, err := parse_hex(strings.TrimSuffix(path[1], ".bin"))
+			raw, ok := chain.Blocks[hash]
+			if err != nil || !ok {
+				http.Error(w, "not found", http.StatusNotFound)
+				return
+			}
+			w.Write(raw)
+
+		default:
+			http.Error(w, "not found", http.StatusNotFound)
+		}
+	}))
+}
+
+func mock_write_block_files(t *testing.T, chain *MockChain, hashes [][32]byte) (path string) {
+	//a bitcoin data directory with the blocks in one unobfuscated blk file
+	path = t.TempDir()
+	if err := os.Mkdir(path+"/blocks", 0755); err != nil {
+		t.Fatal(err)
+	}
+	var data []byte
+	for _, hash := range hashes {
+		var record [8]byte
+		binary.LittleEndian.PutUint32(record[0:4], COMBInfo.Magic)
+		binary.LittleEndian.PutUint32(record[4:8], uint32(len(chain.Blocks[hash])))
+		data = append(data, record[:]...)
+		data = append(data, chain.Blocks[hash]...)
+	}
+	if err := ioutil.WriteFile(path+"/blocks/blk00000.dat", data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func mock_index_varint(value uint64) (data []byte) {
+	//the inverse of index_parse_varint
+	data = []byte{byte(value & 0x7f)}
+	for value > 0x7f {
+		value = (value >> 7) - 1
+		data = append([]byte{byte(value&0x7f) | 0x80}, data...)
+	}
+	return data
+}
+
+func mock_write_block_index(t *testing.T, chain *MockChain, path string, hashes [][32]byte, indexed int) {
+	//a block index for the blk file written by mock_write_block_files, with only the first few blocks flushed to it
+	index, err := leveldb.OpenFile(path+"/blocks/index", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	var pos uint64
+	for _, hash := range hashes[:indexed] {
+		pos += 8
+		var value []byte
+		value = append(value, mock_index_varint(250000)...)
+		value = append(value, mock_index_varint(chain.Height[hash])...)
+		value = append(value, mock_index_varint(INDEX_BLOCK_HAVE_DATA)...)
+		value = append(value, mock_index_varint(1)...)
+		value = append(value, mock_index_varint(0)...)
+		value = append(value, mock_index_varint(pos)...)
+		value = append(value, chain.Blocks[hash][:80]...)
+		var internal [32]byte = swap_endian(hash)
+		if err = index.Put(append([]byte{'b'}, internal[:]...), value, nil); err != nil {
+			t.Fatal(err)
+		}
+		pos += uint64(len(chain.Blocks[hash]))
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+	"math/big"
+	"os"
+	"path/filepath"
+)
+
+//offline direct mining, the best chain is picked from the headers in a copy of the blk files (no bitcoin core needed)
+
+var OfflineInfo struct {
+	Headers map[[32]byte]BlockHeader
+	Files   map[string]int64 //blk file -> size when it was last scanned
+}
+
+func offline_scan_file(path string) (err error) {
+	//only the headers are read, the rest of every block is skipped over
+	var f *os.File
+	if f, err = os.Open(path); err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var offset int64
+	for {
+		var data [88]byte //magic(4),size(4),header(80)
+		if _, err = f.ReadAt(data[:], offset); err != nil {
+			break //end of file, or a truncated block being written
+		}
+		direct_deobfuscate(data[:], offset)
+		if binary.LittleEndian.Uint32(data[0:4]) != COMBInfo.Magic {
+			break //preallocated space
+		}
+		var size uint32 = binary.LittleEndian.Uint32(data[4:8])
+		header, _ := btc_parse_header(data[8:])
+		if pow_check_header(header) == nil {
+			OfflineInfo.Headers[header.Hash] = header
+		}
+		offset += 8 + int64(size)
+	}
+	return nil
+}
+
+func offline_scan(path string) (err error) {
+	if OfflineInfo.Headers == nil {
+		OfflineInfo.Headers = make(map[[32]byte]BlockHeader)
+		OfflineInfo.Files = make(map[string]int64)
+	}
+	var block_files []string
+	if block_files, err = filepath.Glob(path + "/blocks/blk*.dat"); err != nil {
+		return err
+	}
+
+	//blk files are only appended to, so only rescan the ones that grew
+	var scanned int
+	for _, file := range block_files {
+		var stats os.FileInfo
+		if stats, err = os.Stat(file); err != nil {
+			return err
+		}
+		if OfflineInfo.Files[file] == stats.Size() {
+			continue
+		}
+		if err = offline_scan_file(file); err != nil {
+			return err
+		}
+		OfflineInfo.Files[file] = stats.Size()
+		scanned++
+	}
+	if scanned != 0 {
+		log.Printf("(offline) scanned %d block files, %d headers\n", scanned, len(OfflineInfo.Headers))
+	}
+	return nil
+}
+
+func offline_get_chains(path string) (chain ChainData, err error) {
+	combcore_set_status("Scanning...")
+	if err = offline_scan(path); err != nil {
+		return chain, err
+	}
+
+	//cumulative work and height of every header that connects to our chain start
+	type ChainWork struct {
+		Work   *big.Int
+		Height uint64
+	}
+	var start [32]byte
+	var start_height uint64
+	var first bool = true
+	for height, hash := range COMBInfo.Checkpoint {
+		if first || height < start_height {
+			start, start_height = hash, height
+			first = false
+		}
+	}
+	var works map[[32]byte]*ChainWork = map[[32]byte]*ChainWork{start: {Work: new(big.Int), Height: start_height}}
+
+	var best [32]byte = start
+	for hash := range OfflineInfo.Headers {
+		//walk back until we hit something we already know, then fill in forwards
+		var path [][32]byte
+		var h [32]byte = hash
+		var base *ChainWork
+		for {
+			if w, ok := works[h]; ok {
+				base = w
+				break
+			}
+			header, ok := OfflineInfo.Headers[h]
+			if !ok {
+				break //doesnt connect to the chain start (orphan or before it)
+			}
+			path = append(path, h)
+			h = header.Previous
+		}
+		for i := len(path) - 1; i >= 0; i-- {
+			var w *ChainWork
+			if base != nil {
+				w = &ChainWork{Work: new(big.Int).Add(base.Work, pow_work(OfflineInfo.Headers[path[i]].Bits)), Height: base.Height + 1}
+			}
+			works[path[i]] = w //nil marks headers that dont connect
+			base = w
+		}
+		if w := works[hash]; w != nil {
+			if c := w.Work.Cmp(works[best].Work); c > 0 || (c == 0 && hash == COMBInfo.Hash) {
+				best = hash
+			}
+		}
+	}
+
+	if best == start && COMBInfo.Hash != start {
+		return chain, fmt.Errorf("no blocks in the block files connect to the chain start %X", start)
+	}
+	chain.TopHash = best
+	chain.Height = works[best].Height
+	chain.KnownHeight = chain.Height
+	return chain, nil
+}
+
+func offline_header_source() HeaderSource {
+	return HeaderSource{Get: func(hash [32]byte) ([]BlockHeader, error) {
+		header, ok := OfflineInfo.Headers[hash]
+		if !ok {
+			return nil, fmt.Errorf("cannot find header for %X", hash)
+		}
+		return []BlockHeader{header}, nil
+	}}
+}
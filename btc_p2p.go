@@ -0,0 +1,401 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"time"
+)
+
+const P2P_PROTOCOL_VERSION = 70015
+const P2P_MAX_HEADERS = 2000
+const P2P_MAX_PAYLOAD = 32 * 1024 * 1024
+const P2P_BLOCK_BATCH = 16
+const P2P_MSG_BLOCK = 2
+const P2P_TIMEOUT = 2 * time.Minute
+
+type P2PConn struct {
+	Conn   net.Conn
+	Reader *bufio.Reader
+	Height uint64 //the peers height when we connected (from its version message)
+}
+
+func p2p_checksum(payload []byte) (sum [4]byte) {
+	var h [32]byte = sha256.Sum256(payload)
+	h = sha256.Sum256(h[:])
+	copy(sum[:], h[0:4])
+	return sum
+}
+
+func p2p_write_varint(buf *bytes.Buffer, value uint64) {
+	var data [9]byte
+	switch {
+	case value < 0xfd:
+		buf.WriteByte(byte(value))
+	case value <= 0xffff:
+		data[0] = 0xfd
+		binary.LittleEndian.PutUint16(data[1:], uint16(value))
+		buf.Write(data[:3])
+	case value <= 0xffffffff:
+		data[0] = 0xfe
+		binary.LittleEndian.PutUint32(data[1:], uint32(value))
+		buf.Write(data[:5])
+	default:
+		data[0] = 0xff
+		binary.LittleEndian.PutUint64(data[1:], value)
+		buf.Write(data[:9])
+	}
+}
+
+func p2p_write_message(peer *P2PConn, command string, payload []byte) (err error) {
+	//see https://en.bitcoin.it/wiki/Protocol_documentation#Message_structure
+	var header [24]byte
+	binary.LittleEndian.PutUint32(header[0:4], COMBInfo.Magic)
+	copy(header[4:16], command)
+	binary.LittleEndian.PutUint32(header[16:20], uint32(len(payload)))
+	checksum := p2p_checksum(payload)
+	copy(header[20:24], checksum[:])
+
+	peer.Conn.SetWriteDeadline(time.Now().Add(P2P_TIMEOUT))
+	if _, err = peer.Conn.Write(header[:]); err != nil {
+		return err
+	}
+	if _, err = peer.Conn.Write(payload); err != nil {
+		return err
+	}
+	return nil
+}
+
+func p2p_read_message(peer *P2PConn) (command string, payload []byte, err error) {
+	var header [24]byte
+	peer.Conn.SetReadDeadline(time.Now().Add(P2P_TIMEOUT))
+	if _, err = io.ReadFull(peer.Reader, header[:]); err != nil {
+		return "", nil, err
+	}
+	if binary.LittleEndian.Uint32(header[0:4]) != COMBInfo.Magic {
+		return "", nil, fmt.Errorf("wrong network magic %X", header[0:4])
+	}
+	command = string(bytes.TrimRight(header[4:16], "\x00"))
+	length := binary.LittleEndian.Uint32(header[16:20])
+	if length > P2P_MAX_PAYLOAD {
+		return "", nil, fmt.Errorf("%s message too large (%d bytes)", command, length)
+	}
+	payload = make([]byte, length)
+	if _, err = io.ReadFull(peer.Reader, payload); err != nil {
+		return "", nil, err
+	}
+	if checksum := p2p_checksum(payload); !bytes.Equal(checksum[:], header[20:24]) {
+		return "", nil, fmt.Errorf("%s message has a bad checksum", command)
+	}
+	return command, payload, nil
+}
+
+func p2p_wait_message(peer *P2PConn, command string) (payload []byte, err error) {
+	//read until we get the message we want, keeping the connection alive while we wait
+	var got string
+	for {
+		if got, payload, err = p2p_read_message(peer); err != nil {
+			return nil, err
+		}
+		switch got {
+		case command:
+			return payload, nil
+		case "ping":
+			if err = p2p_write_message(peer, "pong", payload); err != nil {
+				return nil, err
+			}
+		case "notfound":
+			return nil, fmt.Errorf("peer does not have the requested data")
+		}
+	}
+}
+
+func p2p_version_payload() []byte {
+	var buf bytes.Buffer
+	var data [8]byte
+	binary.LittleEndian.PutUint32(data[0:4], P2P_PROTOCOL_VERSION)
+	buf.Write(data[0:4])
+	buf.Write(make([]byte, 8)) //services (none)
+	binary.LittleEndian.PutUint64(data[0:8], uint64(time.Now().Unix()))
+	buf.Write(data[0:8])
+	buf.Write(make([]byte, 26)) //addr_recv
+	buf.Write(make([]byte, 26)) //addr_from
+	binary.LittleEndian.PutUint64(data[0:8], rand.Uint64())
+	buf.Write(data[0:8])
+	var agent string = "/combcore/"
+	p2p_write_varint(&buf, uint64(len(agent)))
+	buf.WriteString(agent)
+	buf.Write(make([]byte, 4)) //start height
+	buf.WriteByte(0)           //relay, we dont want transactions
+	return buf.Bytes()
+}
+
+func p2p_connect(addr string) (peer *P2PConn, err error) {
+	var conn net.Conn
+	if conn, err = net.DialTimeout("tcp", addr, 30*time.Second); err != nil {
+		return nil, err
+	}
+	peer = &P2PConn{Conn: conn, Reader: bufio.NewReader(conn)}
+
+	if err = p2p_write_message(peer, "version", p2p_version_payload()); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	//wait for both the peers version and its verack
+	var version, verack bool
+	for !(version && verack) {
+		var command string
+		var payload []byte
+		if command, payload, err = p2p_read_message(peer); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		switch command {
+		case "version":
+			//version(4),services(8),timestamp(8),addr_recv(26),addr_from(26),nonce(8),user agent(var),start height(4)
+			if len(payload) < 81 {
+				conn.Close()
+				return nil, fmt.Errorf("version message too short")
+			}
+			agent_size, adv, _ := btc_parse_varint(payload[80:])
+			if offset := 80 + uint64(adv) + agent_size; uint64(len(payload)) >= offset+4 {
+				peer.Height = uint64(binary.LittleEndian.Uint32(payload[offset:]))
+			}
+			if err = p2p_write_message(peer, "verack", nil); err != nil {
+				conn.Close()
+				return nil, err
+			}
+			version = true
+		case "verack":
+			verack = true
+		}
+	}
+	return peer, nil
+}
+
+func p2p_locator(history *map[[32]byte][32]byte) (locator [][32]byte) {
+	//hashes from our tip backwards, dense at first then exponentially sparser
+	var hash [32]byte = COMBInfo.Hash
+	var step int = 1
+	for hash != empty {
+		locator = append(locator, hash)
+		if len(locator) >= 10 {
+			step *= 2
+		}
+		for i := 0; i < step && hash != empty; i++ {
+			hash = (*history)[hash]
+		}
+	}
+	return locator
+}
+
+func p2p_get_headers(peer *P2PConn, locator [][32]byte) (headers [][80]byte, err error) {
+	var buf bytes.Buffer
+	var data [4]byte
+	binary.LittleEndian.PutUint32(data[:], P2P_PROTOCOL_VERSION)
+	buf.Write(data[:])
+	p2p_write_varint(&buf, uint64(len(locator)))
+	for _, hash := range locator {
+		hash = swap_endian(hash)
+		buf.Write(hash[:])
+	}
+	buf.Write(empty[:]) //stop hash, get as many as possible
+
+	if err = p2p_write_message(peer, "getheaders", buf.Bytes()); err != nil {
+		return nil, err
+	}
+	var payload []byte
+	if payload, err = p2p_wait_message(peer, "headers"); err != nil {
+		return nil, err
+	}
+
+	count, adv, err := btc_parse_varint(payload)
+	if err != nil {
+		return nil, err
+	}
+	payload = payload[adv:]
+	if count > P2P_MAX_HEADERS || uint64(len(payload)) < count*81 {
+		return nil, fmt.Errorf("headers message is malformed")
+	}
+	headers = make([][80]byte, count)
+	for i := range headers {
+		copy(headers[i][:], payload[0:80])
+		payload = payload[81:] //header(80),tx count(1, always zero)
+	}
+	return headers, nil
+}
+
+func p2p_trace_chain(peer *P2PConn, history *map[[32]byte][32]byte) (chain [][32]byte, err error) {
+	//ask the peer for headers after our tip until it has nothing more to give
+	var headers [][80]byte
+	var locator [][32]byte = p2p_locator(history)
+	for {
+		if headers, err = p2p_get_headers(peer, locator); err != nil {
+			return nil, err
+		}
+		for _, raw := range headers {
+			header, _ := btc_parse_header(raw[:])
+			if len(chain) == 0 {
+				if _, ok := (*history)[header.Previous]; !ok {
+					return nil, fmt.Errorf("headers do not connect to a known block (%X)", header.Previous)
+				}
+			} else if header.Previous != chain[len(chain)-1] {
+				return nil, fmt.Errorf("headers are not in order (%X)", header.Hash)
+			}
+			pow_cache_header(header)
+			chain = append(chain, header.Hash)
+		}
+		if len(headers) < P2P_MAX_HEADERS {
+			break
+		}
+		locator = [][32]byte{chain[len(chain)-1]}
+		combcore_set_status(fmt.Sprintf("Tracing (%d headers)...", len(chain)))
+	}
+	return chain, nil
+}
+
+func p2p_header_source(peer *P2PConn) HeaderSource {
+	//getheaders returns whatever follows the locator, so ask from the parent of the block we want
+	return HeaderSource{Batch: true, Get: func(hash [32]byte) (headers []BlockHeader, err error) {
+		var parent [32]byte
+		var ok bool
+		if parent, ok = COMBInfo.Chain[hash]; !ok || parent == empty {
+			var header BlockHeader
+			if header, ok = PowInfo.Headers[hash]; !ok {
+				return nil, fmt.Errorf("cannot find parent of %X", hash)
+			}
+			parent = header.Previous
+		}
+		if peer == nil {
+			if peer, err = p2p_connect(BTC.P2PAddr); err != nil {
+				return nil, err
+			}
+			defer func() {
+				peer.Conn.Close()
+				peer = nil
+			}()
+		}
+		var raw [][80]byte
+		if raw, err = p2p_get_headers(peer, [][32]byte{parent}); err != nil {
+			return nil, err
+		}
+		for _, r := range raw {
+			header, _ := btc_parse_header(r[:])
+			headers = append(headers, header)
+		}
+		return headers, nil
+	}}
+}
+
+func p2p_get_blocks(peer *P2PConn, hashes [][32]byte) (blocks map[[32]byte]*BlockData, err error) {
+	var buf bytes.Buffer
+	var data [4]byte
+	p2p_write_varint(&buf, uint64(len(hashes)))
+	for _, hash := range hashes {
+		binary.LittleEndian.PutUint32(data[:], P2P_MSG_BLOCK) //non-witness blocks, we dont need witness data
+		buf.Write(data[:])
+		hash = swap_endian(hash)
+		buf.Write(hash[:])
+	}
+	if err = p2p_write_message(peer, "getdata", buf.Bytes()); err != nil {
+		return nil, err
+	}
+
+	//blocks should come back in order but dont rely on it
+	blocks = make(map[[32]byte]*BlockData)
+	for len(blocks) < len(hashes) {
+		var payload []byte
+		if payload, err = p2p_wait_message(peer, "block"); err != nil {
+			return nil, err
+		}
+		block := new(BlockData)
+		if err = btc_parse_block(payload, block); err != nil {
+			return nil, err
+		}
+		blocks[block.Hash] = block
+	}
+	return blocks, nil
+}
+
+func p2p_get_chains(addr string) (chain ChainData, err error) {
+	var peer *P2PConn
+	var trace [][32]byte
+	if peer, err = p2p_connect(addr); err != nil {
+		return chain, err
+	}
+	defer peer.Conn.Close()
+
+	if trace, err = p2p_trace_chain(peer, &COMBInfo.Chain); err != nil {
+		return chain, err
+	}
+
+	chain.TopHash = COMBInfo.Hash
+	if len(trace) != 0 {
+		chain.TopHash = trace[len(trace)-1]
+	}
+	chain.Height = peer.Height
+	chain.KnownHeight = peer.Height
+	return chain, nil
+}
+
+func p2p_get_block_range(addr string, target [32]byte, history *map[[32]byte][32]byte, length uint64, out chan<- BlockData) (err error) {
+	defer close(out)
+	var peer *P2PConn
+	var chain [][32]byte
+
+	if peer, err = p2p_connect(addr); err != nil {
+		return err
+	}
+	defer peer.Conn.Close()
+
+	if chain, err = p2p_trace_chain(peer, history); err != nil {
+		return err
+	}
+
+	//the peer may have moved on since we picked the target, stop there anyway
+	var found bool
+	for i, hash := range chain {
+		if hash == target {
+			chain = chain[:i+1]
+			found = true
+			break
+		}
+	}
+	if !found {
+		return fmt.Errorf("peer no longer has %X on its chain", target)
+	}
+	if err = pow_check_chain(chain, p2p_header_source(peer)); err != nil {
+		return err
+	}
+
+	for i := 0; i < len(chain); i += P2P_BLOCK_BATCH {
+		var batch [][32]byte = chain[i:]
+		if len(batch) > P2P_BLOCK_BATCH {
+			batch = batch[:P2P_BLOCK_BATCH]
+		}
+		var blocks map[[32]byte]*BlockData
+		if blocks, err = p2p_get_blocks(peer, batch); err != nil {
+			return err
+		}
+		for _, hash := range batch {
+			block, ok := blocks[hash]
+			if !ok {
+				return fmt.Errorf("peer did not send block %X", hash)
+			}
+			out <- *block
+		}
+
+		var progress float64 = (float64(i) / float64(length)) * 100.0
+		combcore_set_status(fmt.Sprintf("Mining (%.2f%%)...", progress))
+	}
+
+	log.Printf("(p2p) mined %d blocks from %s\n", len(chain), addr)
+	return nil
+}
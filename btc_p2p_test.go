@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"net"
+	"sync"
+	"testing"
+)
+
+//a stand-in bitcoin peer serving a mock chain over the p2p protocol
+
+type MockPeer struct {
+	Lock       sync.Mutex
+	Chain      *MockChain
+	Reverse    bool //answer getdata back to front
+	Version    bool //got our version
+	Verack     bool //got our verack before anything else
+	Pongs      int
+	GetHeaders int
+}
+
+func mock_p2p_peer(t *testing.T, peer *MockPeer) (addr string) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	//connections are closed and waited for when the test ends, so they dont outlive it
+	var lock sync.Mutex
+	var conns []net.Conn
+	var wait sync.WaitGroup
+	t.Cleanup(func() {
+		listener.Close()
+		lock.Lock()
+		for _, conn := range conns {
+			conn.Close()
+		}
+		lock.Unlock()
+		wait.Wait()
+	})
+	wait.Add(1)
+	go func() {
+		defer wait.Done()
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			lock.Lock()
+			conns = append(conns, conn)
+			lock.Unlock()
+			wait.Add(1)
+			go func() {
+				defer wait.Done()
+				mock_p2p_serve(peer, conn)
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func mock_p2p_serve(peer *MockPeer, conn net.Conn) {
+	defer conn.Close()
+	var p *P2PConn = &P2PConn{Conn: conn, Reader: bufio.NewReader(conn)}
+
+	//the handshake, we only talk once we have their version and they have ours
+	command, _, err := p2p_read_message(p)
+	if err != nil || command != "version" {
+		return
+	}
+	peer.Lock.Lock()
+	peer.Version = true
+	var height uint64 = uint64(len(mock_best_chain(peer.Chain)) - 1)
+	peer.Lock.Unlock()
+	var version []byte = p2p_version_payload()
+	binary.LittleEndian.PutUint32(version[len(version)-5:], uint32(height)) //start height(4),relay(1)
+	p2p_write_message(p, "version", version)
+	p2p_write_message(p, "verack", nil)
+	if command, _, err = p2p_read_message(p); err != nil || command != "verack" {
+		return
+	}
+	peer.Lock.Lock()
+	peer.Verack = true
+	peer.Lock.Unlock()
+	p2p_write_message(p, "ping", []byte{1, 2, 3, 4, 5, 6, 7, 8})
+
+	for {
+		var payload []byte
+		if command, payload, err = p2p_read_message(p); err != nil {
+			return
+		}
+		peer.Lock.Lock()
+		peer.Chain.Lock.Lock()
+		switch command {
+		case "pong":
+			peer.Pongs++
+		case "getheaders":
+			peer.GetHeaders++
+			p2p_write_message(p, "headers", mock_p2p_headers(peer.Chain, payload))
+		case "getdata":
+			var blocks, missing [][]byte
+			count, adv, _ := btc_parse_varint(payload)
+			for i := uint64(0); i < count; i++ {
+				var inv []byte = payload[uint64(adv)+i*36 : uint64(adv)+(i+1)*36]
+				var hash [32]byte
+				copy(hash[:], inv[4:36])
+				if block, ok := peer.Chain.Blocks[swap_endian(hash)]; ok {
+					blocks = append(blocks, block)
+				} else {
+					missing = append(missing, inv)
+				}
+			}
+			if peer.Reverse {
+				for i, j := 0, len(blocks)-1; i < j; i, j = i+1, j-1 {
+					blocks[i], blocks[j] = blocks[j], blocks[i]
+				}
+			}
+			for _, block := range blocks {
+				p2p_write_message(p, "block", block)
+			}
+			if len(missing) != 0 {
+				var buf bytes.Buffer
+				p2p_write_varint(&buf, uint64(len(missing)))
+				buf.Write(bytes.Join(missing, nil))
+				p2p_write_message(p, "notfound", buf.Bytes())
+			}
+		}
+		peer.Chain.Lock.Unlock()
+		peer.Lock.Unlock()
+	}
+}
+
+func mock_p2p_headers(chain *MockChain, payload []byte) []byte {
+	//headers after the first locator hash on the best chain, like bitcoin core does
+	var best [][32]byte = mock_best_chain(chain)
+	var start int
+	count, adv, _ := btc_parse_varint(payload[4:])
+	var locator []byte = payload[4+int(adv):]
+	for i := uint64(0); i < count && start == 0; i++ {
+		var hash [32]byte
+		copy(hash[:], locator[i*32:(i+1)*32])
+		hash = swap_endian(hash)
+		for h := range best {
+			if best[h] == hash {
+				start = h + 1
+				break
+			}
+		}
+	}
+
+	var headers [][32]byte = best[start:]
+	if len(headers) > P2P_MAX_HEADERS {
+		headers = headers[:P2P_MAX_HEADERS]
+	}
+	var buf bytes.Buffer
+	p2p_write_varint(&buf, uint64(len(headers)))
+	for _, hash := range headers {
+		buf.Write(chain.Blocks[hash][:80])
+		buf.WriteByte(0)
+	}
+	return buf.Bytes()
+}
+
+func p2p_test_start(t *testing.T, confirmations uint) (chain *MockChain, peer *MockPeer) {
+	chain = sync_test_start(t, confirmations)
+	peer = &MockPeer{Chain: chain}
+	BTC.P2PAddr = mock_p2p_peer(t, peer)
+	t.Cleanup(func() { BTC.P2PAddr = "" })
+	return chain, peer
+}
+
+func TestP2PHandshake(t *testing.T) {
+	var chain, peer = p2p_test_start(t, 2)
+	mock_extend(chain, chain.Genesis, 5, 1)
+
+	p, err := p2p_connect(BTC.P2PAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Conn.Close()
+	if p.Height != 5 {
+		t.Fatalf("peer height %d, expected 5", p.Height)
+	}
+
+	//the ping after the handshake is answered while waiting for the first headers, the peer sees it before the second request
+	for i := 0; i < 2; i++ {
+		var headers [][80]byte
+		if headers, err = p2p_get_headers(p, [][32]byte{chain.Genesis}); err != nil {
+			t.Fatal(err)
+		}
+		if len(headers) != 5 {
+			t.Fatalf("got %d headers, expected 5", len(headers))
+		}
+	}
+	peer.Lock.Lock()
+	defer peer.Lock.Unlock()
+	if !peer.Version || !peer.Verack || peer.Pongs != 1 {
+		t.Fatalf("version %t, verack %t, pongs %d", peer.Version, peer.Verack, peer.Pongs)
+	}
+}
+
+func TestP2PSync(t *testing.T) {
+	//more than one getheaders batch, with the blocks sent back to front
+	var chain, peer = p2p_test_start(t, 2)
+	peer.Reverse = true
+	var a [][32]byte = mock_extend(chain, chain.Genesis, P2P_MAX_HEADERS+100, 1)
+	btc_sync()
+	sync_test_check(t, chain, 2)
+	peer.Lock.Lock()
+	if peer.GetHeaders < 2 {
+		t.Fatalf("%d getheaders, expected more than one batch", peer.GetHeaders)
+	}
+	peer.Lock.Unlock()
+
+	//a fork deeper than the dense part of the locator, the peer has to find it from the sparse part
+	mock_extend(chain, a[len(a)-50], 60, 2)
+	btc_sync()
+	sync_test_check(t, chain, 2)
+}
+
+func TestP2PNotFound(t *testing.T) {
+	var chain, _ = p2p_test_start(t, 2)
+	var a [][32]byte = mock_extend(chain, chain.Genesis, 3, 1)
+
+	p, err := p2p_connect(BTC.P2PAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Conn.Close()
+	if _, err = p2p_get_blocks(p, [][32]byte{a[0], {1}}); err == nil {
+		t.Fatal("got blocks the peer does not have")
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+//replays the FuzzParseBlock corpus, so toolchains without native fuzzing still run it
+
+const PARSE_CORPUS = "testdata/fuzz/FuzzParseBlock"
+
+func parse_test_corpus(t *testing.T, name string) (data []byte) {
+	//the go test fuzz v1 format, with a single []byte value
+	raw, err := ioutil.ReadFile(filepath.Join(PARSE_CORPUS, name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var lines []string = strings.Split(strings.TrimSpace(string(raw)), "\n")
+	if len(lines) != 2 || lines[0] != "go test fuzz v1" || !strings.HasPrefix(lines[1], "[]byte(") || !strings.HasSuffix(lines[1], ")") {
+		t.Fatalf("%s is not a corpus file", name)
+	}
+	value, err := strconv.Unquote(strings.TrimSuffix(strings.TrimPrefix(lines[1], "[]byte("), ")"))
+	if err != nil {
+		t.Fatalf("%s (%s)", name, err.Error())
+	}
+	return []byte(value)
+}
+
+func TestParseCorpus(t *testing.T) {
+	var tests = []struct {
+		name    string
+		valid   bool
+		commits int
+	}{
+		{"legacy", true, 2},
+		{"segwit", true, 2},
+		{"truncated_header", false, 0},
+		{"truncated_witness", false, 0},
+		{"truncated_varint", false, 0},
+		{"oversized_tx_count", false, 0},
+		{"oversized_script", false, 0},
+	}
+	for _, test := range tests {
+		var data []byte = parse_test_corpus(t, test.name)
+		var block BlockData
+		var err error = btc_parse_block(data, &block)
+		if test.valid && err != nil {
+			t.Errorf("%s: %s", test.name, err.Error())
+		} else if !test.valid && err == nil {
+			t.Errorf("%s: parsed", test.name)
+		} else if test.valid && len(block.Commits) != test.commits {
+			t.Errorf("%s: %d commits, expected %d", test.name, len(block.Commits), test.commits)
+		}
+		if test.valid {
+			//every prefix of a block is malformed
+			for i := 0; i < len(data); i++ {
+				if btc_parse_block(data[:i], &block) == nil {
+					t.Errorf("%s: parsed when truncated to %d bytes", test.name, i)
+					break
+				}
+			}
+		}
+		parse_test_check(t, data)
+	}
+
+	//every corpus file is in the table, including ones the fuzzer added
+	files, err := filepath.Glob(filepath.Join(PARSE_CORPUS, "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range files {
+		parse_test_check(t, parse_test_corpus(t, filepath.Base(file)))
+	}
+}
+
+func parse_test_check(t *testing.T, data []byte) {
+	//malformed input is an error, never a panic
+	t.Helper()
+	var block BlockData
+	btc_parse_block(data, &block)
+	if rest, _, err := btc_parse_transaction(data, nil); err == nil && len(rest) >= len(data) {
+		t.Fatalf("transaction parsed without consuming anything")
+	}
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"math/big"
+)
+
+//proof of work checks for chains traced from a bitcoin source, see bitcoin/src/pow.cpp
+
+const POW_RETARGET_INTERVAL = 2016
+const POW_TARGET_TIMESPAN = 14 * 24 * 60 * 60
+const POW_TARGET_SPACING = 10 * 60
+const POW_HEADER_BATCH = 2000
+
+type BlockHeader struct {
+	Hash     [32]byte
+	Version  uint32
+	Previous [32]byte
+	Time     uint32
+	Bits     uint32
+}
+
+type PowParams struct {
+	Limit         uint32 //bits of the easiest allowed target
+	MinDifficulty bool   //testnet, blocks 20 minutes apart may use the limit
+	NoRetarget    bool
+}
+
+type HeaderSource struct {
+	Get   func(hash [32]byte) ([]BlockHeader, error)
+	Batch bool //Get also returns the headers following hash on the sources best chain
+}
+
+var PowInfo struct {
+	Headers map[[32]byte]BlockHeader
+}
+
+func btc_parse_header(data []byte) (header BlockHeader, err error) {
+	if len(data) < 80 {
+		return header, fmt.Errorf("header is truncated (%d bytes)", len(data))
+	}
+	header.Hash = sha256.Sum256(data[0:80])
+	header.Hash = swap_endian(sha256.Sum256(header.Hash[:]))
+	header.Version = binary.LittleEndian.Uint32(data[0:4])
+	copy(header.Previous[:], data[4:36])
+	header.Previous = swap_endian(header.Previous)
+	header.Time = binary.LittleEndian.Uint32(data[68:72])
+	header.Bits = binary.LittleEndian.Uint32(data[72:76])
+	return header, nil
+}
+
+func pow_params() PowParams {
+	return NETWORKS[COMBInfo.Network].Pow
+}
+
+func pow_target(bits uint32) (target *big.Int, err error) {
+	//decode compact bits, see arith_uint256::SetCompact
+	var size uint = uint(bits >> 24)
+	var word uint32 = bits & 0x007fffff
+	if word != 0 && bits&0x00800000 != 0 {
+		return nil, fmt.Errorf("bits %08x are negative", bits)
+	}
+	target = new(big.Int)
+	if size <= 3 {
+		target.SetUint64(uint64(word >> (8 * (3 - size))))
+	} else {
+		target.SetUint64(uint64(word))
+		target.Lsh(target, 8*(size-3))
+	}
+	if target.BitLen() > 256 {
+		return nil, fmt.Errorf("bits %08x overflow", bits)
+	}
+	return target, nil
+}
+
+func pow_compact(target *big.Int) (bits uint32) {
+	//encode a target as compact bits, see arith_uint256::GetCompact
+	var size uint = uint((target.BitLen() + 7) / 8)
+	var word uint64
+	if size <= 3 {
+		word = target.Uint64() << (8 * (3 - size))
+	} else {
+		word = new(big.Int).Rsh(target, 8*(size-3)).Uint64()
+	}
+	if word&0x00800000 != 0 {
+		word >>= 8
+		size++
+	}
+	return uint32(word) | uint32(size)<<24
+}
+
+func pow_work(bits uint32) *big.Int {
+	//expected number of hashes for a target, 2^256 / (target+1)
+	target, err := pow_target(bits)
+	if err != nil || target.Sign() == 0 {
+		return new(big.Int)
+	}
+	var work *big.Int = new(big.Int).Lsh(big.NewInt(1), 256)
+	return work.Div(work, target.Add(target, big.NewInt(1)))
+}
+
+func pow_cache_header(header BlockHeader) {
+	if PowInfo.Headers == nil {
+		PowInfo.Headers = make(map[[32]byte]BlockHeader)
+	}
+	PowInfo.Headers[header.Hash] = header
+}
+
+func pow_get_header(hash [32]byte, source HeaderSource) (header BlockHeader, err error) {
+	var ok bool
+	if header, ok = PowInfo.Headers[hash]; ok {
+		return header, nil
+	}
+
+	//we mostly walk backwards, so start a batch further back on our own chain and fetch forwards
+	var start [32]byte = hash
+	for i := 0; source.Batch && i < POW_HEADER_BATCH-1; i++ {
+		if parent, ok := COMBInfo.Chain[start]; ok && parent != empty {
+			start = parent
+		} else {
+			break
+		}
+	}
+	for _, s := range [][32]byte{start, hash} {
+		var headers []BlockHeader
+		if headers, err = source.Get(s); err != nil {
+			return header, err
+		}
+		for _, h := range headers {
+			pow_cache_header(h)
+		}
+		if header, ok = PowInfo.Headers[hash]; ok {
+			return header, nil
+		}
+	}
+	return header, fmt.Errorf("cannot find header for %X", hash)
+}
+
+func pow_required_bits(previous BlockHeader, height uint64, header BlockHeader, source HeaderSource) (bits uint32, err error) {
+	//the bits a block at height must have, see GetNextWorkRequired
+	var params PowParams = pow_params()
+	if params.NoRetarget {
+		return previous.Bits, nil
+	}
+
+	if height%POW_RETARGET_INTERVAL != 0 {
+		if !params.MinDifficulty {
+			return previous.Bits, nil
+		}
+		if header.Time > previous.Time+POW_TARGET_SPACING*2 {
+			return params.Limit, nil
+		}
+		//otherwise its the last bits that werent a special min difficulty block
+		var h BlockHeader = previous
+		for i := height - 1; i%POW_RETARGET_INTERVAL != 0 && h.Bits == params.Limit; i-- {
+			if h, err = pow_get_header(h.Previous, source); err != nil {
+				return 0, err
+			}
+		}
+		return h.Bits, nil
+	}
+
+	//retarget, find the first block of the period that just finished
+	var first BlockHeader = previous
+	for i := 0; i < POW_RETARGET_INTERVAL-1; i++ {
+		if first, err = pow_get_header(first.Previous, source); err != nil {
+			return 0, err
+		}
+	}
+
+	var timespan int64 = int64(previous.Time) - int64(first.Time)
+	if timespan < POW_TARGET_TIMESPAN/4 {
+		timespan = POW_TARGET_TIMESPAN / 4
+	}
+	if timespan > POW_TARGET_TIMESPAN*4 {
+		timespan = POW_TARGET_TIMESPAN * 4
+	}
+
+	var target, limit *big.Int
+	if target, err = pow_target(previous.Bits); err != nil {
+		return 0, err
+	}
+	limit, _ = pow_target(params.Limit)
+	target.Mul(target, big.NewInt(timespan))
+	target.Div(target, big.NewInt(POW_TARGET_TIMESPAN))
+	if target.Cmp(limit) > 0 {
+		target = limit
+	}
+	return pow_compact(target), nil
+}
+
+func pow_check_header(header BlockHeader) (err error) {
+	var target, limit *big.Int
+	if target, err = pow_target(header.Bits); err != nil {
+		return err
+	}
+	limit, _ = pow_target(pow_params().Limit)
+	if target.Sign() == 0 || target.Cmp(limit) > 0 {
+		return fmt.Errorf("block %X has bits out of range (%08x)", header.Hash, header.Bits)
+	}
+	if new(big.Int).SetBytes(header.Hash[:]).Cmp(target) > 0 {
+		return fmt.Errorf("block %X does not meet its target", header.Hash)
+	}
+	return nil
+}
+
+func pow_find_fork(fork [32]byte) (height uint64, ours [][32]byte, err error) {
+	//the fork has to be on our current chain, everything above it would be replaced
+	var hash [32]byte = COMBInfo.Hash
+	height = COMBInfo.Height
+	for hash != fork {
+		ours = append(ours, hash)
+		if hash = COMBInfo.Chain[hash]; hash == empty {
+			return 0, nil, fmt.Errorf("chain does not fork from our chain (%X)", fork)
+		}
+		height--
+	}
+	return height, ours, nil
+}
+
+func pow_prune(tip [32]byte) {
+	//only the last retarget period is ever needed again
+	var keep map[[32]byte]BlockHeader = make(map[[32]byte]BlockHeader)
+	var hash [32]byte = tip
+	for i := 0; i < POW_RETARGET_INTERVAL; i++ {
+		header, ok := PowInfo.Headers[hash]
+		if !ok {
+			break
+		}
+		keep[hash] = header
+		hash = header.Previous
+	}
+	PowInfo.Headers = keep
+}
+
+func pow_check_chain(chain [][32]byte, source HeaderSource) (err error) {
+	//validate a traced chain before any of it is mined: linkage, targets, retargets and total work
+	if len(chain) == 0 {
+		return nil
+	}
+
+	var headers []BlockHeader = make([]BlockHeader, len(chain))
+	for i, hash := range chain {
+		if headers[i], err = pow_get_header(hash, source); err != nil {
+			return err
+		}
+	}
+
+	var height uint64
+	var ours [][32]byte
+	if height, ours, err = pow_find_fork(headers[0].Previous); err != nil {
+		return err
+	}
+	if err = combcore_check_fork(height); err != nil {
+		return err
+	}
+
+	var previous BlockHeader
+	if previous, err = pow_get_header(headers[0].Previous, source); err != nil {
+		return err
+	}
+
+	var work *big.Int = new(big.Int)
+	for _, header := range headers {
+		height++
+		if header.Previous != previous.Hash {
+			return fmt.Errorf("block %X does not connect to %X", header.Hash, previous.Hash)
+		}
+		if err = pow_check_header(header); err != nil {
+			return err
+		}
+		if err = combcore_check_checkpoint(height, header.Hash); err != nil {
+			return err
+		}
+		var bits uint32
+		if bits, err = pow_required_bits(previous, height, header, source); err != nil {
+			return err
+		}
+		if header.Bits != bits {
+			return fmt.Errorf("block %X at %d has wrong bits (%08x != %08x)", header.Hash, height, header.Bits, bits)
+		}
+		work.Add(work, pow_work(header.Bits))
+		previous = header
+	}
+
+	//a reorg has to replace our blocks with more work, not just more blocks
+	if len(ours) != 0 {
+		var current *big.Int = new(big.Int)
+		for _, hash := range ours {
+			var header BlockHeader
+			if header, err = pow_get_header(hash, source); err != nil {
+				return err
+			}
+			current.Add(current, pow_work(header.Bits))
+		}
+		if work.Cmp(current) <= 0 {
+			return fmt.Errorf("chain to %X has less work than ours", chain[len(chain)-1])
+		}
+		log.Printf("(pow) reorg of %d blocks has more work, accepting\n", len(ours))
+	}
+
+	pow_prune(chain[len(chain)-1])
+	return nil
+}
@@ -8,17 +8,80 @@ import (
 	"net/http"
 )
 
-func rest_trace_chain(client *http.Client, url string, target [32]byte, history *map[[32]byte][32]byte, length uint64) (chain [][32]byte, err error) {
-	var raw_json json.RawMessage
-	var headers []struct {
-		Height            uint64
-		Previousblockhash string
+const REST_BLOCK_ATTEMPTS = 3
+
+func rest_get_headers(client *http.Client, url string, hash [32]byte, count int) (headers []BlockHeader, err error) {
+	//returns up to count headers starting at hash, following the best chain
+	var raw_data []byte
+	if raw_data, err = btc_rest_call(client, fmt.Sprintf("%s/headers/%d/%x.bin", url, count, hash)); err != nil {
+		return nil, err
+	}
+	if len(raw_data)%80 != 0 {
+		return nil, fmt.Errorf("headers are gibberish got (%s)", string(raw_data))
 	}
+	for len(raw_data) != 0 {
+		var header BlockHeader
+		if header, err = btc_parse_header(raw_data); err != nil {
+			return nil, err
+		}
+		headers = append(headers, header)
+		raw_data = raw_data[80:]
+	}
+	if len(headers) == 0 || headers[0].Hash != hash {
+		return nil, fmt.Errorf("cannot find header for %X", hash)
+	}
+	return headers, nil
+}
 
-	//if the target is already in the chain then return early
-	if _, ok := (*history)[target]; ok {
-		return chain, nil
+func rest_header_source(client *http.Client, url string) HeaderSource {
+	return HeaderSource{Batch: true, Get: func(hash [32]byte) ([]BlockHeader, error) {
+		return rest_get_headers(client, url, hash, POW_HEADER_BATCH)
+	}}
+}
+
+func rest_get_hash_by_height(client *http.Client, url string, height uint64) (hash [32]byte, err error) {
+	var raw_data []byte
+	if raw_data, err = btc_rest_call(client, fmt.Sprintf("%s/blockhashbyheight/%d.bin", url, height)); err != nil {
+		return hash, err
+	}
+	if len(raw_data) != 32 {
+		return hash, fmt.Errorf("hash is gibberish got (%s)", string(raw_data))
+	}
+	copy(hash[:], raw_data)
+	return swap_endian(hash), nil
+}
+
+func rest_trace_forward(client *http.Client, url string, start [32]byte, target [32]byte, length uint64) (chain [][32]byte, err error) {
+	//follow the nodes best chain forward from a known block in batches until we reach the target
+	var headers []BlockHeader
+	var hash [32]byte = start
+	for hash != target {
+		if headers, err = rest_get_headers(client, url, hash, POW_HEADER_BATCH); err != nil {
+			return nil, err
+		}
+		if len(headers) == 1 {
+			return nil, fmt.Errorf("chain ended at %X before reaching %X", hash, target)
+		}
+		for _, header := range headers[1:] {
+			if header.Previous != hash {
+				return nil, fmt.Errorf("headers are not in order (%X)", header.Hash)
+			}
+			pow_cache_header(header)
+			chain = append(chain, header.Hash)
+			if hash = header.Hash; hash == target {
+				break
+			}
+		}
+
+		//just for the end user, this wont factor in any reorgs
+		var progress float64 = (float64(len(chain)) / float64(length)) * 100.0
+		combcore_set_status(fmt.Sprintf("Tracing (%.2f%%)...", progress))
 	}
+	return chain, nil
+}
+
+func rest_trace_back(client *http.Client, url string, target [32]byte, history *map[[32]byte][32]byte, length uint64) (chain [][32]byte, err error) {
+	var headers []BlockHeader
 
 	//keep tracing the chain back from the tip until we find a block thats known (in history)
 	var hash [32]byte = target
@@ -27,18 +90,11 @@ func rest_trace_chain(client *http.Client, url string, target [32]byte, history
 			break
 		}
 		chain = append(chain, hash)
-		if raw_json, err = btc_rest_call(client, fmt.Sprintf("%s/headers/1/%x.json", url, hash)); err != nil {
-			return nil, err
-		}
-		if err = json.Unmarshal(raw_json, &headers); err != nil {
-			return nil, fmt.Errorf("header is gibberish (%s) got (%s)", err.Error(), string(raw_json))
-		}
-		if len(headers) == 0 {
-			return nil, fmt.Errorf("cannot find header for %X", hash)
-		}
-		if hash, err = parse_hex(headers[0].Previousblockhash); err != nil {
+		if headers, err = rest_get_headers(client, url, hash, 1); err != nil {
 			return nil, err
 		}
+		pow_cache_header(headers[0])
+		hash = headers[0].Previous
 
 		//just for the end user, this wont factor in any reorgs
 		var progress float64 = (float64(len(chain)) / float64(length)) * 100.0
@@ -53,41 +109,65 @@ func rest_trace_chain(client *http.Client, url string, target [32]byte, history
 	return chain, nil
 }
 
+func rest_trace_chain(client *http.Client, url string, target [32]byte, history *map[[32]byte][32]byte, length uint64) (chain [][32]byte, err error) {
+	//if the target is already in the chain then return early
+	if _, ok := (*history)[target]; ok {
+		return chain, nil
+	}
+
+	//if our tip is still on the nodes best chain we can walk forward in big batches
+	var hash [32]byte
+	if hash, err = rest_get_hash_by_height(client, url, COMBInfo.Height); err != nil {
+		log.Printf("(rest) cant get block hash by height, tracing back instead (%s)\n", err.Error())
+	} else if hash == COMBInfo.Hash {
+		if chain, err = rest_trace_forward(client, url, hash, target, length); err == nil {
+			return chain, nil
+		}
+		log.Printf("(rest) forward trace failed, tracing back instead (%s)\n", err.Error())
+	}
+
+	//otherwise theres a reorg, only the backward walk can find where the chains fork
+	return rest_trace_back(client, url, target, history, length)
+}
+
 func rest_get_block_range(client *http.Client, url string, target [32]byte, history *map[[32]byte][32]byte, length uint64, out chan<- BlockData) (err error) {
 	defer close(out)
 	var chain [][32]byte
-	var block BlockData
 
 	//gets a list of blocks that connect the target to a known block (does not have to be the current chain tip)
 	//every block in this list is unknown to combcore
 	if chain, err = rest_trace_chain(client, url, target, history, length); err != nil {
 		return err
 	}
-
-	for i, h := range chain {
-		if block, err = rest_get_block(client, url, h); err != nil {
-			return err
-		}
-		var progress float64 = (float64(i) / float64(length)) * 100.0
-		combcore_set_status(fmt.Sprintf("Mining (%.2f%%)...", progress))
-		out <- block
+	if err = pow_check_chain(chain, rest_header_source(client, url)); err != nil {
+		return err
 	}
 
-	return nil
+	//blocks are downloaded in parallel but still handed over in chain order
+	return btc_fetch_ordered(chain, int(*btc_rest_workers), length, out, func(hash [32]byte) (BlockData, error) {
+		return rest_get_block(client, url, hash)
+	})
 }
 
 func rest_get_block(client *http.Client, url string, hash [32]byte) (block BlockData, err error) {
 	var raw_data []byte
 	var raw_block *BlockData = new(BlockData)
 
-	if raw_data, err = btc_rest_call(client, fmt.Sprintf("%s/block/%x.bin", url, hash)); err != nil {
-		return block, err
-	}
-
-	btc_parse_block(raw_data, raw_block)
-
-	if raw_block.Hash != hash {
-		log.Panicf("recieved wrong block %X != %X", raw_block.Hash, hash)
+	//a bad block is most likely a broken transfer, so retry a few times before giving up
+	for attempt := 1; ; attempt++ {
+		if raw_data, err = btc_rest_call(client, fmt.Sprintf("%s/block/%x.bin", url, hash)); err != nil {
+			return block, err
+		}
+		if err = btc_parse_block(raw_data, raw_block); err == nil && raw_block.Hash != hash {
+			err = fmt.Errorf("recieved wrong block %X != %X", raw_block.Hash, hash)
+		}
+		if err == nil {
+			break
+		}
+		if attempt == REST_BLOCK_ATTEMPTS {
+			return block, err
+		}
+		log.Printf("(rest) retrying block %X (%s)\n", hash, err.Error())
 	}
 
 	block.Hash = raw_block.Hash
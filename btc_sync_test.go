@@ -0,0 +1,246 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+
+	"libcomb"
+)
+
+func sync_test_start(t *testing.T, confirmations uint) (chain *MockChain) {
+	//fresh regtest node mining from a mock REST server, with its db in a temp dir
+	COMBInfo.Network = "regtest"
+	chain = mock_chain_new()
+	*comb_checkpoints = fmt.Sprintf("0:%x", chain.Genesis)
+	*comb_confirmations = confirmations
+
+	PowInfo.Headers = nil
+	pow_cache_header(chain.Headers[chain.Genesis])
+	sync_test_load(t, t.TempDir())
+
+	var server = mock_rest_server(chain)
+	BTC.RestClient = &http.Client{}
+	BTC.Backends = []Backend{{URL: server.URL + "/rest", Healthy: true}}
+	BTC.RestURL = BTC.Backends[0].URL
+	t.Cleanup(func() {
+		server.Close()
+		db_close()
+		*comb_checkpoints = ""
+	})
+	return chain
+}
+
+func sync_test_reset(path string) {
+	//back to the chain start, as if the node was just started
+	libcomb.Reset()
+	combcore_set_network()
+	COMBInfo.Chain = map[[32]byte][32]byte{COMBInfo.Hash: empty}
+	COMBInfo.Path = path
+}
+
+func sync_test_load(t *testing.T, path string) {
+	//no path keeps the db in memory
+	sync_test_reset(path)
+	db_is_new = false
+	if path == "" {
+		db_open_memory()
+	} else if err := db_open(); err != nil {
+		t.Fatal(err)
+	}
+	db_start()
+	neominer_init()
+}
+
+func sync_test_check(t *testing.T, chain *MockChain, confirmations uint64) {
+	//the node should be at the mock tip, with only buried blocks stored
+	t.Helper()
+	var best [][32]byte = mock_best_chain(chain)
+	var height uint64 = uint64(len(best) - 1)
+	if COMBInfo.Hash != chain.Tip || COMBInfo.Height != height || libcomb.GetHeight() != height {
+		t.Fatalf("at %X (%d, libcomb %d), expected %X (%d)", COMBInfo.Hash, COMBInfo.Height, libcomb.GetHeight(), chain.Tip, height)
+	}
+
+	var final uint64
+	if height > confirmations {
+		final = height - confirmations
+	}
+	if neominer_final_height() != final {
+		t.Fatalf("final height %d, expected %d", neominer_final_height(), final)
+	}
+
+	var fingerprint [32]byte
+	for h := uint64(1); h <= final; h++ {
+		var metadata BlockMetadata = db_get_block_by_height(h)
+		if metadata.Height != h || metadata.Hash != best[h] || metadata.Previous != best[h-1] {
+			t.Fatalf("db has %X at %d (%d), expected %X", metadata.Hash, h, metadata.Height, best[h])
+		}
+		fingerprint = xor_hex(fingerprint, db_compute_block_fingerprint(chain.Commits[best[h]]))
+	}
+	if metadata := db_get_block_by_height(final + 1); metadata.Height != 0 {
+		t.Fatalf("provisional block %d was stored", metadata.Height)
+	}
+	if db_fingerprint := db_compute_db_fingerprint(); db_fingerprint != fingerprint {
+		t.Fatalf("db fingerprint %X, expected %X", db_fingerprint, fingerprint)
+	}
+}
+
+func TestSyncInitial(t *testing.T) {
+	var chain *MockChain = sync_test_start(t, 3)
+	mock_extend(chain, chain.Genesis, 50, 1)
+	btc_sync()
+	sync_test_check(t, chain, 3)
+
+	//and again from where it left off
+	mock_extend(chain, chain.Tip, 5, 1)
+	btc_sync()
+	sync_test_check(t, chain, 3)
+}
+
+func TestSyncShallowReorg(t *testing.T) {
+	var chain *MockChain = sync_test_start(t, 6)
+	var a [][32]byte = mock_extend(chain, chain.Genesis, 30, 1)
+	btc_sync()
+	sync_test_check(t, chain, 6)
+
+	//replace the last 3 blocks, this stays above the confirmation depth so the db is not touched
+	var stored BlockMetadata = db_get_block_by_height(24)
+	mock_extend(chain, a[26], 4, 2)
+	btc_sync()
+	sync_test_check(t, chain, 6)
+	if db_get_block_by_height(24) != stored {
+		t.Fatal("stored block was rewritten")
+	}
+}
+
+func TestSyncDeepReorg(t *testing.T) {
+	var chain *MockChain = sync_test_start(t, 2)
+	var a [][32]byte = mock_extend(chain, chain.Genesis, 30, 1)
+	btc_sync()
+	sync_test_check(t, chain, 2)
+
+	//fork below the stored blocks, they have to be removed from the db and libcomb
+	mock_extend(chain, a[9], 25, 2)
+	btc_sync()
+	sync_test_check(t, chain, 2)
+}
+
+func TestSyncRejectsLessWork(t *testing.T) {
+	var chain *MockChain = sync_test_start(t, 2)
+	var a [][32]byte = mock_extend(chain, chain.Genesis, 20, 1)
+	btc_sync()
+	sync_test_check(t, chain, 2)
+
+	//a shorter fork with less work is served as the tip, nothing should change
+	var b [][32]byte = mock_extend(chain, a[14], 3, 2)
+	btc_sync()
+	mock_set_tip(chain, a[19])
+	sync_test_check(t, chain, 2)
+
+	//until it overtakes us
+	mock_extend(chain, b[2], 3, 2)
+	btc_sync()
+	sync_test_check(t, chain, 2)
+}
+
+func TestSyncFingerprintsPerBlock(t *testing.T) {
+	var chain *MockChain = sync_test_start(t, 0)
+	mock_extend(chain, chain.Genesis, 10, 1)
+	btc_sync()
+	sync_test_check(t, chain, 0)
+
+	var best [][32]byte = mock_best_chain(chain)
+	for h := uint64(1); h <= 10; h++ {
+		var fingerprint [32]byte = db_compute_block_fingerprint(chain.Commits[best[h]])
+		if metadata := db_get_block_by_height(h); metadata.Fingerprint != fingerprint {
+			t.Fatalf("block %d has fingerprint %X, expected %X", h, metadata.Fingerprint, fingerprint)
+		}
+	}
+}
+
+func TestSyncOffline(t *testing.T) {
+	var chain *MockChain = sync_test_start(t, 2)
+	var a [][32]byte = mock_extend(chain, chain.Genesis, 30, 1)
+	var b [][32]byte = mock_extend(chain, a[19], 5, 2) //shorter fork, less work than a
+	mock_set_tip(chain, a[29])
+
+	//the rest backend is unreachable, everything has to come from the blk files
+	BTC.Backends[0].URL = "http://127.0.0.1:1/rest"
+	BTC.RestURL = BTC.Backends[0].URL
+	BTC.DirectKey = [8]byte{}
+	BTC.DirectPath = mock_write_block_files(t, chain, append(append([][32]byte{chain.Genesis}, b...), a...))
+	BTC.Offline = true
+	OfflineInfo.Headers = nil
+	t.Cleanup(func() {
+		BTC.DirectPath = ""
+		BTC.Offline = false
+	})
+
+	btc_sync()
+	sync_test_check(t, chain, 2)
+}
+
+func TestSyncMemory(t *testing.T) {
+	//the whole pipeline, reorgs included, without a db on disk
+	var chain *MockChain = sync_test_start(t, 2)
+	db_close()
+	sync_test_load(t, "")
+	var a [][32]byte = mock_extend(chain, chain.Genesis, 30, 1)
+	btc_sync()
+	sync_test_check(t, chain, 2)
+
+	mock_extend(chain, a[9], 25, 2)
+	btc_sync()
+	sync_test_check(t, chain, 2)
+	if metadata, err := db_get_block_by_hash(a[5]); err != nil || metadata.Height != 6 {
+		t.Fatalf("block %X found at %d (%v), expected 6", a[5], metadata.Height, err)
+	}
+}
+
+func TestSyncStaleIndex(t *testing.T) {
+	//a copy of a running node, its index was last flushed 10 blocks before the tip
+	var chain *MockChain = sync_test_start(t, 2)
+	var a [][32]byte = mock_extend(chain, chain.Genesis, 30, 1)
+	var files [][32]byte = append([][32]byte{chain.Genesis}, a...)
+
+	BTC.Backends[0].URL = "http://127.0.0.1:1/rest"
+	BTC.RestURL = BTC.Backends[0].URL
+	BTC.DirectKey = [8]byte{}
+	BTC.DirectPath = mock_write_block_files(t, chain, files)
+	mock_write_block_index(t, chain, BTC.DirectPath, files, 21)
+	BTC.Offline = true
+	OfflineInfo.Headers = nil
+	t.Cleanup(func() {
+		BTC.DirectPath = ""
+		BTC.Offline = false
+	})
+
+	btc_sync()
+	sync_test_check(t, chain, 2)
+}
+
+func TestSyncProvisionalRace(t *testing.T) {
+	//rpcs ask about pending blocks while the sync reorgs them, run with -race
+	var chain *MockChain = sync_test_start(t, 6)
+	var a [][32]byte = mock_extend(chain, chain.Genesis, 30, 1)
+	var done chan struct{} = make(chan struct{})
+	var stopped chan struct{} = make(chan struct{})
+	go func() {
+		defer close(stopped)
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			neominer_has_provisional_commits()
+			neominer_is_provisional(a[0])
+		}
+	}()
+	btc_sync()
+	mock_extend(chain, a[26], 4, 2)
+	btc_sync()
+	close(done)
+	<-stopped
+	sync_test_check(t, chain, 6)
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+type FetchTest struct {
+	Lock     sync.Mutex
+	Fail     int //index of the block that fails, -1 for none
+	Fetched  int
+	InFlight int
+	Most     int //most fetches in flight at once
+}
+
+func fetch_test_run(test *FetchTest, chain [][32]byte, workers int) (out [][32]byte, err error) {
+	var index map[[32]byte]int = make(map[[32]byte]int)
+	for i, hash := range chain {
+		index[hash] = i
+	}
+	var blocks chan BlockData = make(chan BlockData)
+	var done chan error = make(chan error, 1)
+	go func() {
+		done <- btc_fetch_ordered(chain, workers, uint64(len(chain)), blocks, func(hash [32]byte) (BlockData, error) {
+			test.Lock.Lock()
+			test.Fetched++
+			if test.InFlight++; test.InFlight > test.Most {
+				test.Most = test.InFlight
+			}
+			test.Lock.Unlock()
+			//earlier blocks take longer, so they finish out of order
+			time.Sleep(time.Duration(len(chain)-index[hash]) * 100 * time.Microsecond)
+			test.Lock.Lock()
+			test.InFlight--
+			test.Lock.Unlock()
+			if index[hash] == test.Fail {
+				return BlockData{}, fmt.Errorf("block %d failed", index[hash])
+			}
+			return BlockData{Hash: hash}, nil
+		})
+		close(blocks)
+	}()
+	for block := range blocks {
+		out = append(out, block.Hash)
+	}
+	return out, <-done
+}
+
+func TestFetchOrdered(t *testing.T) {
+	var chain [][32]byte
+	for i := 0; i < 50; i++ {
+		chain = append(chain, [32]byte{byte(i), 1})
+	}
+	for _, test := range []struct {
+		chain   [][32]byte
+		workers int
+		fail    int
+		limit   int //most fetches expected in flight
+	}{
+		{chain, 0, -1, 1},
+		{chain, 1, -1, 1},
+		{chain, 4, -1, 4},
+		{chain, 100, -1, 100},
+		{nil, 4, -1, 0},
+		{chain, 1, 10, 1},
+		{chain, 4, 10, 4},
+		{chain, 4, 0, 4},
+		{chain, 4, 49, 4},
+	} {
+		var fetch *FetchTest = &FetchTest{Fail: test.fail}
+		out, err := fetch_test_run(fetch, test.chain, test.workers)
+		var expected int = len(test.chain)
+		if test.fail != -1 {
+			expected = test.fail
+		}
+		if (err == nil) != (test.fail == -1) || len(out) != expected {
+			t.Fatalf("%d workers failing at %d: got %d blocks (%v), expected %d", test.workers, test.fail, len(out), err, expected)
+		}
+		for i := range out {
+			if out[i] != test.chain[i] {
+				t.Fatalf("%d workers: block %d is %X, expected %X", test.workers, i, out[i], test.chain[i])
+			}
+		}
+		if fetch.Most > test.limit {
+			t.Fatalf("%d workers: %d fetches in flight", test.workers, fetch.Most)
+		}
+		//a failure stops queuing, only the fetches already in flight finish
+		if test.fail != -1 && fetch.Fetched > test.fail+test.limit+1 {
+			t.Fatalf("%d workers failing at %d: %d fetches", test.workers, test.fail, fetch.Fetched)
+		}
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"time"
+)
+
+//minimal ZMTP 3.0 subscriber for bitcoin cores zmq notifications, see https://rfc.zeromq.org/spec/23/
+
+const ZMQ_FLAG_MORE = 0x01
+const ZMQ_FLAG_LONG = 0x02
+const ZMQ_FLAG_COMMAND = 0x04
+const ZMQ_MAX_FRAME = 32 * 1024 * 1024
+
+func zmq_write_frame(conn net.Conn, flags byte, body []byte) (err error) {
+	var header []byte
+	if len(body) > 255 {
+		header = make([]byte, 9)
+		header[0] = flags | ZMQ_FLAG_LONG
+		binary.BigEndian.PutUint64(header[1:], uint64(len(body)))
+	} else {
+		header = []byte{flags, byte(len(body))}
+	}
+	if _, err = conn.Write(header); err != nil {
+		return err
+	}
+	_, err = conn.Write(body)
+	return err
+}
+
+func zmq_read_frame(reader *bufio.Reader) (flags byte, body []byte, err error) {
+	var size uint64
+	if flags, err = reader.ReadByte(); err != nil {
+		return 0, nil, err
+	}
+	if flags&ZMQ_FLAG_LONG != 0 {
+		var data [8]byte
+		if _, err = io.ReadFull(reader, data[:]); err != nil {
+			return 0, nil, err
+		}
+		size = binary.BigEndian.Uint64(data[:])
+	} else {
+		var b byte
+		if b, err = reader.ReadByte(); err != nil {
+			return 0, nil, err
+		}
+		size = uint64(b)
+	}
+	if size > ZMQ_MAX_FRAME {
+		return 0, nil, fmt.Errorf("frame too large (%d bytes)", size)
+	}
+	body = make([]byte, size)
+	if _, err = io.ReadFull(reader, body); err != nil {
+		return 0, nil, err
+	}
+	return flags, body, nil
+}
+
+func zmq_read_message(reader *bufio.Reader) (frames [][]byte, err error) {
+	for {
+		var flags byte
+		var body []byte
+		if flags, body, err = zmq_read_frame(reader); err != nil {
+			return nil, err
+		}
+		if flags&ZMQ_FLAG_COMMAND != 0 {
+			continue //nothing we need to handle after the handshake
+		}
+		frames = append(frames, body)
+		if flags&ZMQ_FLAG_MORE == 0 {
+			return frames, nil
+		}
+	}
+}
+
+func zmq_handshake(conn net.Conn, reader *bufio.Reader) (err error) {
+	//greeting: signature(10),version(2),mechanism(20),as-server(1),filler(31)
+	var greeting [64]byte
+	greeting[0] = 0xff
+	greeting[9] = 0x7f
+	greeting[10] = 3
+	greeting[11] = 0
+	copy(greeting[12:32], "NULL")
+	if _, err = conn.Write(greeting[:]); err != nil {
+		return err
+	}
+	if _, err = io.ReadFull(reader, greeting[:]); err != nil {
+		return err
+	}
+	if greeting[0] != 0xff || greeting[9]&1 != 1 || greeting[10] < 3 {
+		return fmt.Errorf("not a ZMTP 3 publisher")
+	}
+
+	//READY command with our socket type
+	var ready []byte = []byte{5}
+	ready = append(ready, "READY"...)
+	ready = append(ready, 11)
+	ready = append(ready, "Socket-Type"...)
+	ready = append(ready, 0, 0, 0, 3)
+	ready = append(ready, "SUB"...)
+	if err = zmq_write_frame(conn, ZMQ_FLAG_COMMAND, ready); err != nil {
+		return err
+	}
+
+	var flags byte
+	var body []byte
+	if flags, body, err = zmq_read_frame(reader); err != nil {
+		return err
+	}
+	if flags&ZMQ_FLAG_COMMAND == 0 || len(body) < 6 || string(body[1:6]) != "READY" {
+		return fmt.Errorf("publisher did not send READY")
+	}
+	return nil
+}
+
+func zmq_subscribe(addr string) (err error) {
+	var conn net.Conn
+	if conn, err = net.DialTimeout("tcp", addr, 30*time.Second); err != nil {
+		return err
+	}
+	defer conn.Close()
+	var reader *bufio.Reader = bufio.NewReader(conn)
+
+	if err = zmq_handshake(conn, reader); err != nil {
+		return err
+	}
+	for _, topic := range []string{"hashblock", "rawblock"} {
+		//ZMTP 3.0 subscriptions are plain messages starting with 1
+		if err = zmq_write_frame(conn, 0, append([]byte{1}, topic...)); err != nil {
+			return err
+		}
+	}
+	log.Printf("(zmq) subscribed to %s\n", addr)
+
+	for {
+		var frames [][]byte
+		if frames, err = zmq_read_message(reader); err != nil {
+			return err
+		}
+		if len(frames) < 2 {
+			continue
+		}
+		switch string(frames[0]) {
+		case "rawblock":
+			block := new(BlockData)
+			if err = btc_parse_block(frames[1], block); err != nil {
+				log.Printf("(zmq) bad block (%s)\n", err.Error())
+				btc_notify()
+				continue
+			}
+			select {
+			case BTC.Blocks <- *block:
+			default: //full, fall back to a normal sync
+				btc_notify()
+			}
+		case "hashblock":
+			btc_notify()
+		}
+	}
+}
+
+func zmq_listen(addr string) {
+	addr = strings.TrimPrefix(addr, "tcp://")
+	for {
+		err := zmq_subscribe(addr)
+		log.Printf("(zmq) connection to %s lost (%v), polling until it comes back\n", addr, err)
+		time.Sleep(time.Second * 10)
+	}
+}
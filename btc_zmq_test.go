@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+//a local zmq publisher, standing in for bitcoin cores zmqpubrawblock and zmqpubhashblock
+
+type MockSubscriber struct {
+	Conn   net.Conn
+	Topics []string
+}
+
+func mock_zmq_publisher(t *testing.T) (addr string, subscribers chan MockSubscriber) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	subscribers = make(chan MockSubscriber, 1)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			var subscriber MockSubscriber = MockSubscriber{Conn: conn}
+			if subscriber.Topics, err = mock_zmq_handshake(conn); err != nil {
+				t.Errorf("handshake failed (%s)", err.Error())
+				conn.Close()
+				continue
+			}
+			subscribers <- subscriber
+		}
+	}()
+	return listener.Addr().String(), subscribers
+}
+
+func mock_zmq_handshake(conn net.Conn) (topics []string, err error) {
+	var reader *bufio.Reader = bufio.NewReader(conn)
+	var greeting [64]byte
+	greeting[0] = 0xff
+	greeting[9] = 0x7f
+	greeting[10] = 3
+	copy(greeting[12:32], "NULL")
+	greeting[32] = 1 //as-server
+	if _, err = conn.Write(greeting[:]); err != nil {
+		return nil, err
+	}
+	if _, err = io.ReadFull(reader, greeting[:]); err != nil {
+		return nil, err
+	}
+	if greeting[0] != 0xff || greeting[9] != 0x7f || greeting[10] != 3 || string(bytes.TrimRight(greeting[12:32], "\x00")) != "NULL" {
+		return nil, io.ErrUnexpectedEOF
+	}
+
+	flags, body, err := zmq_read_frame(reader)
+	if err != nil {
+		return nil, err
+	}
+	if flags&ZMQ_FLAG_COMMAND == 0 || !bytes.HasPrefix(body, []byte("\x05READY")) || !bytes.HasSuffix(body, []byte("Socket-Type\x00\x00\x00\x03SUB")) {
+		return nil, io.ErrUnexpectedEOF
+	}
+	var ready []byte = append([]byte("\x05READY\x0bSocket-Type"), 0, 0, 0, 3)
+	if err = zmq_write_frame(conn, ZMQ_FLAG_COMMAND, append(ready, "PUB"...)); err != nil {
+		return nil, err
+	}
+
+	for len(topics) < 2 {
+		if _, body, err = zmq_read_frame(reader); err != nil {
+			return nil, err
+		}
+		if len(body) == 0 || body[0] != 1 {
+			return nil, io.ErrUnexpectedEOF
+		}
+		topics = append(topics, string(body[1:]))
+	}
+	return topics, nil
+}
+
+func mock_zmq_publish(t *testing.T, conn net.Conn, topic string, body []byte) {
+	//topic, body and a sequence number, like bitcoin core
+	if err := zmq_write_frame(conn, ZMQ_FLAG_MORE, []byte(topic)); err != nil {
+		t.Fatal(err)
+	}
+	if err := zmq_write_frame(conn, ZMQ_FLAG_MORE, body); err != nil {
+		t.Fatal(err)
+	}
+	if err := zmq_write_frame(conn, 0, []byte{0, 0, 0, 0}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func zmq_test_block(t *testing.T) BlockData {
+	t.Helper()
+	select {
+	case block := <-BTC.Blocks:
+		return block
+	case <-time.After(5 * time.Second):
+		t.Fatal("no block was queued")
+	}
+	return BlockData{}
+}
+
+func zmq_test_notify(t *testing.T) {
+	t.Helper()
+	select {
+	case <-BTC.Notify:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no sync was triggered")
+	}
+}
+
+func zmq_test_subscribe(addr string) (done chan error) {
+	done = make(chan error, 1)
+	go func() { done <- zmq_subscribe(addr) }()
+	return done
+}
+
+func TestZMQ(t *testing.T) {
+	COMBInfo.Network = "regtest"
+	var chain *MockChain = mock_chain_new()
+	var a [][32]byte = mock_extend(chain, chain.Genesis, 3, 1)
+	BTC.Notify = make(chan struct{}, 1)
+	BTC.Blocks = make(chan BlockData, 1)
+	addr, subscribers := mock_zmq_publisher(t)
+
+	var done chan error = zmq_test_subscribe(addr)
+	var subscriber MockSubscriber = <-subscribers
+	if len(subscriber.Topics) != 2 || subscriber.Topics[0] != "hashblock" || subscriber.Topics[1] != "rawblock" {
+		t.Fatalf("subscribed to %v", subscriber.Topics)
+	}
+
+	//a raw block goes straight to the miner, a hash only wakes up the sync
+	mock_zmq_publish(t, subscriber.Conn, "rawblock", chain.Blocks[a[0]])
+	if block := zmq_test_block(t); block.Hash != a[0] || len(block.Commits) != len(chain.Commits[a[0]]) {
+		t.Fatalf("queued %X, expected %X", block.Hash, a[0])
+	}
+	mock_zmq_publish(t, subscriber.Conn, "hashblock", a[0][:])
+	zmq_test_notify(t)
+
+	//once the queue is full, or a block cant be parsed, it falls back to a normal sync
+	mock_zmq_publish(t, subscriber.Conn, "rawblock", chain.Blocks[a[1]])
+	mock_zmq_publish(t, subscriber.Conn, "rawblock", chain.Blocks[a[2]])
+	zmq_test_notify(t)
+	if block := zmq_test_block(t); block.Hash != a[1] {
+		t.Fatalf("queued %X, expected %X", block.Hash, a[1])
+	}
+	mock_zmq_publish(t, subscriber.Conn, "rawblock", chain.Blocks[a[2]][:100])
+	zmq_test_notify(t)
+
+	//a dropped connection ends the subscription, the next one starts over with a new handshake
+	subscriber.Conn.Close()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatal("subscription ended without an error")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("subscription did not notice the connection was lost")
+	}
+	done = zmq_test_subscribe(addr)
+	subscriber = <-subscribers
+	mock_zmq_publish(t, subscriber.Conn, "hashblock", a[2][:])
+	zmq_test_notify(t)
+	subscriber.Conn.Close()
+	<-done
+}
@@ -2,10 +2,13 @@ package main
 
 import (
 	"encoding/binary"
+	"fmt"
 	"libcomb"
 	"log"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
 	"sync"
 	"syscall"
 
@@ -19,6 +22,7 @@ var COMBInfo struct {
 	Height     uint64
 	Hash       [32]byte
 	Chain      map[[32]byte][32]byte //child -> parent
+	Checkpoint map[uint64][32]byte   //height -> hash, the chain start is the lowest
 	Status     string
 	StatusLock bool
 	Network    string
@@ -34,7 +38,9 @@ func setup_graceful_shutdown() {
 		<-c
 		log.Printf("(combcore) terminate signal detected. shutting down...")
 		critical.Lock()
-		db.Close()
+		if db != nil {
+			db.Close()
+		}
 		shutdown.Unlock()
 		os.Exit(-3)
 	}()
@@ -58,41 +64,165 @@ func combcore_init() {
 	COMBInfo.Chain[COMBInfo.Hash] = empty
 }
 
+type NetworkParams struct {
+	Height  uint64 //chain start, networks without one need it from comb_checkpoints
+	Hash    string
+	Magic   [4]byte
+	Path    string
+	Prefix  map[string]string
+	Testnet bool //use libcombs testnet rules
+	Pow     PowParams
+}
+
+var MAINNET_PREFIX = map[string]string{
+	"stack":           "/stack/data/",
+	"tx":              "/tx/recv/",
+	"key":             "/wallet/data/",
+	"merkle":          "/merkle/data/",
+	"unsigned_merkle": "/contract/data/",
+	"decider":         "/purse/data/",
+}
+
+var TESTNET_PREFIX = map[string]string{
+	"stack":           "\\stack\\data\\",
+	"tx":              "\\tx\\recv\\",
+	"key":             "\\wallet\\data\\",
+	"merkle":          "\\merkle\\data\\",
+	"unsigned_merkle": "\\contract\\data\\",
+	"decider":         "\\purse\\data\\",
+}
+
+var NETWORKS = map[string]NetworkParams{ //every difference between the networks is here (minus whats in libcomb)
+	"mainnet": {
+		Height: 481822,
+		Hash:   "0000000000000000003bec88b7ba0bebd8eb3b1c1c599e44a2b270ad3e8203ca",
+		Magic:  [4]byte{0xf9, 0xbe, 0xb4, 0xd9},
+		Path:   "commits",
+		Prefix: MAINNET_PREFIX,
+		Pow:    PowParams{Limit: 0x1d00ffff},
+	},
+	"testnet": {
+		Height:  0,
+		Hash:    "000000000933ea01ad0ee984209779baaec3ced90fa3f408719526f8d77f4943",
+		Magic:   [4]byte{0x0b, 0x11, 0x09, 0x07},
+		Path:    "commits_testnet",
+		Prefix:  TESTNET_PREFIX,
+		Testnet: true,
+		Pow:     PowParams{Limit: 0x1d00ffff, MinDifficulty: true},
+	},
+	"signet": {
+		Height:  0,
+		Hash:    "00000008819873e925422c1ff0f99f7cc9bbb232af63a077a480a3633bee1ef6",
+		Magic:   [4]byte{0x0a, 0x03, 0xcf, 0x40},
+		Path:    "commits_signet",
+		Prefix:  TESTNET_PREFIX,
+		Testnet: true,
+		Pow:     PowParams{Limit: 0x1e0377ae},
+	},
+	"regtest": {
+		Magic:   [4]byte{0xfa, 0xbf, 0xb5, 0xda},
+		Path:    "commits_regtest",
+		Prefix:  TESTNET_PREFIX,
+		Testnet: true,
+		Pow:     PowParams{Limit: 0x207fffff, NoRetarget: true},
+	},
+}
+
 func combcore_set_network() {
-	COMBInfo.Prefix = make(map[string]string)
 	log.Printf("(combcore) loading in %s mode\n", COMBInfo.Network)
-	//every difference between the networks is here (minus whats in libcomb)
-	switch COMBInfo.Network {
-	case "mainnet":
-		COMBInfo.Height = 481822
-		COMBInfo.Hash, _ = parse_hex("0000000000000000003bec88b7ba0bebd8eb3b1c1c599e44a2b270ad3e8203ca")
-		COMBInfo.Magic = binary.LittleEndian.Uint32([]byte{0xf9, 0xbe, 0xb4, 0xd9})
-		COMBInfo.Path = "commits"
-		COMBInfo.Prefix["stack"] = "/stack/data/"
-		COMBInfo.Prefix["tx"] = "/tx/recv/"
-		COMBInfo.Prefix["key"] = "/wallet/data/"
-		COMBInfo.Prefix["merkle"] = "/merkle/data/"
-		COMBInfo.Prefix["unsigned_merkle"] = "/contract/data/"
-		COMBInfo.Prefix["decider"] = "/purse/data/"
-	case "testnet":
-		COMBInfo.Height = 0
-		COMBInfo.Hash, _ = parse_hex("000000000933ea01ad0ee984209779baaec3ced90fa3f408719526f8d77f4943")
-		COMBInfo.Magic = binary.LittleEndian.Uint32([]byte{0x0B, 0x11, 0x09, 0x07})
-		COMBInfo.Path = "commits_testnet"
-		COMBInfo.Prefix["stack"] = "\\stack\\data\\"
-		COMBInfo.Prefix["tx"] = "\\tx\\recv\\"
-		COMBInfo.Prefix["key"] = "\\wallet\\data\\"
-		COMBInfo.Prefix["merkle"] = "\\merkle\\data\\"
-		COMBInfo.Prefix["unsigned_merkle"] = "\\contract\\data\\"
-		COMBInfo.Prefix["decider"] = "\\purse\\data\\"
-		libcomb.SwitchToTestnet()
-	default:
+	params, ok := NETWORKS[COMBInfo.Network]
+	if !ok {
 		log.Panicf("unknown network %s\n", COMBInfo.Network)
 	}
+	COMBInfo.Height = params.Height
+	COMBInfo.Hash = empty
+	if params.Hash != "" {
+		COMBInfo.Hash, _ = parse_hex(params.Hash)
+	}
+	COMBInfo.Magic = binary.LittleEndian.Uint32(params.Magic[:])
+	COMBInfo.Path = params.Path
+	COMBInfo.Prefix = make(map[string]string)
+	for k, v := range params.Prefix {
+		COMBInfo.Prefix[k] = v
+	}
+	if params.Testnet {
+		libcomb.SwitchToTestnet()
+	}
+
+	COMBInfo.Checkpoint = make(map[uint64][32]byte)
+	if params.Hash != "" {
+		COMBInfo.Checkpoint[COMBInfo.Height] = COMBInfo.Hash
+	}
+	if err := combcore_load_checkpoints(*comb_checkpoints); err != nil {
+		log.Panicf("(combcore) bad checkpoints (%s)\n", err.Error())
+	}
+
+	//otherwise the chain starts at the lowest configured checkpoint (regtest has no fixed chain to start on)
+	if params.Hash == "" {
+		if len(COMBInfo.Checkpoint) == 0 {
+			log.Panicf("(combcore) %s needs its chain start set in comb_checkpoints\n", COMBInfo.Network)
+		}
+		var first bool = true
+		for height, hash := range COMBInfo.Checkpoint {
+			if first || height < COMBInfo.Height {
+				COMBInfo.Height, COMBInfo.Hash = height, hash
+				first = false
+			}
+		}
+	}
 
 	libcomb.SetHeight(COMBInfo.Height)
 }
 
+func combcore_load_checkpoints(list string) (err error) {
+	//extra checkpoints from the config, as height:hash,height:hash
+	for _, c := range strings.Split(list, ",") {
+		if c = strings.TrimSpace(c); c == "" {
+			continue
+		}
+		var parts []string = strings.Split(c, ":")
+		if len(parts) != 2 {
+			return fmt.Errorf("checkpoint %s is not height:hash", c)
+		}
+		var height uint64
+		var hash [32]byte
+		if height, err = strconv.ParseUint(parts[0], 10, 64); err != nil {
+			return err
+		}
+		if hash, err = parse_hex(parts[1]); err != nil {
+			return err
+		}
+		if height < COMBInfo.Height {
+			return fmt.Errorf("checkpoint %d is before the chain start (%d)", height, COMBInfo.Height)
+		}
+		if known, ok := COMBInfo.Checkpoint[height]; ok && known != hash {
+			return fmt.Errorf("checkpoint %d conflicts with %X", height, known)
+		}
+		COMBInfo.Checkpoint[height] = hash
+	}
+	if len(COMBInfo.Checkpoint) > 1 {
+		log.Printf("(combcore) loaded %d checkpoints\n", len(COMBInfo.Checkpoint))
+	}
+	return nil
+}
+
+func combcore_check_checkpoint(height uint64, hash [32]byte) error {
+	if checkpoint, ok := COMBInfo.Checkpoint[height]; ok && checkpoint != hash {
+		return fmt.Errorf("block %X at %d conflicts with checkpoint %X", hash, height, checkpoint)
+	}
+	return nil
+}
+
+func combcore_check_fork(height uint64) error {
+	//a chain may not fork below a checkpoint we already passed
+	for h := range COMBInfo.Checkpoint {
+		if h > height && h <= COMBInfo.Height {
+			return fmt.Errorf("chain forks at %d, below checkpoint %d", height, h)
+		}
+	}
+	return nil
+}
+
 func combcore_dump() {
 	db_inspect()
 	neominer_inspect()
@@ -120,6 +250,10 @@ func combcore_process_block(block Block) (err error) {
 		log.Printf("(combcore) processing %d\n", block.Metadata.Height)
 	}
 
+	if err = combcore_check_checkpoint(block.Metadata.Height, block.Metadata.Hash); err != nil {
+		return err
+	}
+
 	if block.Metadata.Previous != COMBInfo.Hash { //sanity check
 		log.Printf("%d %X %d %X (%X)\n", COMBInfo.Height, COMBInfo.Hash, block.Metadata.Height, block.Metadata.Hash, block.Metadata.Previous)
 		log.Panicf("(combcore) sanity check failed, chain is broken")
@@ -142,30 +276,33 @@ func combcore_process_block(block Block) (err error) {
 	return nil
 }
 
-func combcore_reorg(target [32]byte) {
+func combcore_reorg(target [32]byte, final uint64) {
 	//target is the highest common block between our chain and the new reorged chain
 	//this function should remove all block data after target, and rollback libcomb to target
+	//blocks above final were never written to the db
 	var ok bool
-	var metadata = db_get_block_by_hash(target)
+	var height uint64 = COMBInfo.Height
 
-	log.Printf("(combcore) reorg encountered, rolling back to block %d\n", metadata.Height)
-
-	log.Printf("(combcore) tracing back...\n")
+	log.Printf("(combcore) reorg encountered, tracing back...\n")
 	//trace back our in-memory chain
 	for COMBInfo.Hash != target {
 		if COMBInfo.Hash, ok = COMBInfo.Chain[COMBInfo.Hash]; !ok {
 			log.Panicf("reorg past checkpoint is not possible\n")
 		}
+		height--
 	}
+	log.Printf("(combcore) rolling back to block %d\n", height)
 
-	log.Printf("(combcore) removing blocks from database...\n")
-	//remove reorg'd blocks from the db
-	db_remove_blocks_after(metadata.Height + 1)
+	if height < final {
+		log.Printf("(combcore) removing blocks from database...\n")
+		//remove reorg'd blocks from the db
+		db_remove_blocks_after(height + 1)
+	}
 
 	log.Printf("(combcore) unloading blocks...\n")
 	//unload libcomb to the target height
 	libcomb.GetLock()
-	for COMBInfo.Height != metadata.Height {
+	for COMBInfo.Height != height {
 		COMBInfo.Height = libcomb.UnloadBlock()
 	}
 	libcomb.FinishReorg()
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func combcore_test_checkpoints(t *testing.T, height uint64, checkpoints map[uint64][32]byte) {
+	//a chain started at height, with only the given checkpoints
+	var start uint64 = COMBInfo.Height
+	var previous map[uint64][32]byte = COMBInfo.Checkpoint
+	COMBInfo.Height = height
+	COMBInfo.Checkpoint = checkpoints
+	t.Cleanup(func() {
+		COMBInfo.Height = start
+		COMBInfo.Checkpoint = previous
+	})
+}
+
+func TestLoadCheckpoints(t *testing.T) {
+	var ab, cd string = strings.Repeat("ab", 32), strings.Repeat("cd", 32)
+	var start [32]byte = [32]byte{1}
+	for _, test := range []struct {
+		list  string
+		ok    bool
+		count int
+	}{
+		{"", true, 1},
+		{" , ", true, 1},
+		{"150:" + ab, true, 2},
+		{" 150:" + ab + " , 200:" + cd + ",", true, 3},
+		{"100:01" + strings.Repeat("00", 31), true, 1}, //the chain start again
+		{"150", false, 0},
+		{"150:" + ab + ":" + cd, false, 0},
+		{":" + ab, false, 0},
+		{"x:" + ab, false, 0},
+		{"-150:" + ab, false, 0},
+		{"150:" + ab[:62], false, 0},
+		{"150:" + ab + "ab", false, 0},
+		{"150:" + strings.Repeat("zz", 32), false, 0},
+		{"50:" + ab, false, 0},  //before the chain start
+		{"100:" + cd, false, 0}, //conflicts with the chain start
+		{"150:" + ab + ",150:" + cd, false, 0},
+	} {
+		combcore_test_checkpoints(t, 100, map[uint64][32]byte{100: start})
+		err := combcore_load_checkpoints(test.list)
+		if (err == nil) != test.ok {
+			t.Fatalf("%q gave %v, expected ok %t", test.list, err, test.ok)
+		}
+		if test.ok && len(COMBInfo.Checkpoint) != test.count {
+			t.Fatalf("%q loaded %d checkpoints, expected %d", test.list, len(COMBInfo.Checkpoint), test.count)
+		}
+	}
+
+	//hex is case insensitive
+	combcore_test_checkpoints(t, 100, map[uint64][32]byte{})
+	if err := combcore_load_checkpoints("150:" + strings.ToUpper(ab)); err != nil || COMBInfo.Checkpoint[150][0] != 0xab {
+		t.Fatalf("upper case hash loaded as %X (%v)", COMBInfo.Checkpoint[150], err)
+	}
+}
+
+func TestCheckCheckpoint(t *testing.T) {
+	combcore_test_checkpoints(t, 100, map[uint64][32]byte{100: {1}, 150: {2}})
+	for _, test := range []struct {
+		height uint64
+		hash   [32]byte
+		ok     bool
+	}{
+		{100, [32]byte{1}, true},
+		{150, [32]byte{2}, true},
+		{150, [32]byte{1}, false},
+		{150, [32]byte{}, false},
+		{151, [32]byte{9}, true},
+		{99, [32]byte{9}, true},
+	} {
+		if err := combcore_check_checkpoint(test.height, test.hash); (err == nil) != test.ok {
+			t.Fatalf("block %X at %d gave %v, expected ok %t", test.hash, test.height, err, test.ok)
+		}
+	}
+}
+
+func TestCheckFork(t *testing.T) {
+	//at 300 with checkpoints at the chain start, 150 and 400 (not reached yet)
+	combcore_test_checkpoints(t, 300, map[uint64][32]byte{100: {1}, 150: {2}, 400: {3}})
+	for _, test := range []struct {
+		height uint64
+		ok     bool
+	}{
+		{299, true},
+		{150, true}, //forking right on a checkpoint keeps it
+		{151, true},
+		{149, false},
+		{100, false},
+		{0, false},
+	} {
+		if err := combcore_check_fork(test.height); (err == nil) != test.ok {
+			t.Fatalf("fork at %d gave %v, expected ok %t", test.height, err, test.ok)
+		}
+	}
+
+	//once we pass a checkpoint it protects everything below it
+	COMBInfo.Height = 400
+	if err := combcore_check_fork(399); err == nil {
+		t.Fatal("fork below a passed checkpoint was allowed")
+	}
+	if err := combcore_check_fork(400); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -14,13 +14,24 @@ const (
 var (
 	btc_peer = flag.String("btc_peer", "127.0.0.1", "")
 	btc_port = flag.Uint("btc_port", 8332, "")
+	btc_backends = flag.String("btc_backends", "", "")
+	btc_rest_workers = flag.Uint("btc_rest_workers", 8, "")
 	btc_data = flag.String("btc_data", "", "")
+	btc_offline = flag.Bool("btc_offline", false, "")
+	btc_p2p  = flag.String("btc_p2p", "", "")
+	btc_zmq  = flag.String("btc_zmq", "", "")
+	btc_esplora = flag.String("btc_esplora", "", "")
+	btc_mempool = flag.Bool("btc_mempool", false, "")
 
 	comb_host    = flag.String("comb_host", "127.0.0.1", "")
 	comb_port    = flag.Uint("comb_port", 2211, "")
 	comb_network = flag.String("comb_network", "mainnet", "")
+	comb_peers   = flag.String("comb_peers", "", "")
+	comb_confirmations = flag.Uint("comb_confirmations", 6, "")
+	comb_checkpoints   = flag.String("comb_checkpoints", "", "")
 
 	comb_fingerprint_index = flag.Bool("comb_fingerprint_index", false, "")
+	comb_db_backup = flag.Bool("comb_db_backup", false, "")
 
 	public_api_bind = flag.String("public_api_bind", "", "")
 	private_api_bind = flag.String("private_api_bind", "", "")
@@ -69,7 +69,7 @@ func (c *Control) LoadMerkleSegment(args *MerkleSegment, reply *string) (err err
 
 func (c *Control) GenerateKey(args *interface{}, reply *Key) error {
 	key, _ := libcomb.NewKey()
-	*reply = wallet_stringify_key(key)
+	*reply = wallet_stringify_key(key, nil) //a new key has nothing
 	return nil
 }
 
@@ -148,7 +148,11 @@ func (c *Control) ConstructUnsignedMerkleSegment(args *ConstructUnsignedMerkleSe
 		return err
 	}
 
-	*result = wallet_stringify_unsigned_merkle_segment(m)
+	var balances map[[32]byte]uint64
+	if balances, err = wallet_get_balances([][32]byte{m.ID()}); err != nil {
+		return err
+	}
+	*result = wallet_stringify_unsigned_merkle_segment(m, balances)
 	return nil
 }
 
@@ -286,7 +290,11 @@ func (c *Control) DecideMerkleSegment(args *DecideMerkleSegmentArgs, result *Mer
 		return fmt.Errorf("address mismatch. branches, leaf or signature is invalid")
 	}
 
-	*result = wallet_stringify_merkle_segment(m)
+	var balances map[[32]byte]uint64
+	if balances, err = wallet_get_balances([][32]byte{m.ID()}); err != nil {
+		return err
+	}
+	*result = wallet_stringify_merkle_segment(m, balances)
 	return nil
 }
 
@@ -295,10 +303,35 @@ func (c *Control) GetAddressBalance(args *string, reply *uint64) (err error) {
 	if address, err = parse_hex(*args); err != nil {
 		return err
 	}
+	if *node_mode == LIGHT_NODE {
+		*reply, err = light_get_balance(address)
+		return err
+	}
 	*reply = libcomb.GetBalance(address)
 	return nil
 }
 
+type BalanceInfo struct {
+	Balance     uint64
+	Provisional bool //depends on blocks that are not buried yet
+}
+
+func (c *Control) GetAddressBalanceInfo(args *string, reply *BalanceInfo) (err error) {
+	var address [32]byte
+	if address, err = parse_hex(*args); err != nil {
+		return err
+	}
+	if *node_mode == LIGHT_NODE {
+		//we cant know how deep our peers blocks are
+		reply.Provisional = true
+		reply.Balance, err = light_get_balance(address)
+		return err
+	}
+	reply.Balance = libcomb.GetBalance(address)
+	reply.Provisional = neominer_is_provisional(address)
+	return nil
+}
+
 func (c *Control) CommitAddress(args *string, reply *string) (err error) {
 	var address [32]byte
 	if address, err = parse_hex(*args); err != nil {
@@ -331,6 +364,16 @@ func (c *Control) CheckAddresses(args *[]string, reply *[]string) (err error) {
 			return err
 		}
 		address = libcomb.Commit(address)
+		if *node_mode == LIGHT_NODE {
+			var found bool
+			if _, found, err = light_get_tag(address); err != nil {
+				return err
+			}
+			if !found {
+				*reply = append(*reply, a)
+			}
+			continue
+		}
 		if !libcomb.HaveCommit(address) {
 			*reply = append(*reply, a)
 		}
@@ -338,6 +381,43 @@ func (c *Control) CheckAddresses(args *[]string, reply *[]string) (err error) {
 	return nil
 }
 
+func (c *Control) CheckPendingAddresses(args *[]string, reply *[]string) (err error) {
+	//takes list of addresses and returns the addresses with a commit waiting in the mempool
+	var address [32]byte
+	if *node_mode == LIGHT_NODE {
+		return fmt.Errorf("not available on a light node")
+	}
+
+	for _, a := range *args {
+		if address, err = parse_hex(a); err != nil {
+			return err
+		}
+		address = libcomb.Commit(address)
+		if _, ok := mempool_get_commit(address); ok && !libcomb.HaveCommit(address) {
+			*reply = append(*reply, a)
+		}
+	}
+	return nil
+}
+
+func (c *Control) GetPendingCommit(args *string, reply *string) (err error) {
+	//takes an address and returns the txid of the mempool transaction committing it
+	var address [32]byte
+	if *node_mode == LIGHT_NODE {
+		return fmt.Errorf("not available on a light node")
+	}
+	if address, err = parse_hex(*args); err != nil {
+		return err
+	}
+	address = libcomb.Commit(address)
+	txid, ok := mempool_get_commit(address)
+	if !ok {
+		return fmt.Errorf("commit not in mempool")
+	}
+	*reply = stringify_hex(txid)
+	return nil
+}
+
 func (c *Control) GetCOMBBase(args *int, reply *string) (err error) {
 	var height uint64 = uint64(*args)
 	var combbase [32]byte
@@ -353,17 +433,48 @@ func (c *Control) GetTag(args *string, reply *libcomb.Tag) (err error) {
 	if commit, err = parse_hex(*args); err != nil {
 		return err
 	}
+	if *node_mode == LIGHT_NODE {
+		var found bool
+		if *reply, found, err = light_get_tag(commit); err != nil {
+			return err
+		}
+		if !found {
+			return fmt.Errorf("commit not found")
+		}
+		return nil
+	}
 	if *reply, err = libcomb.GetCommitTag(commit); err != nil {
 		return err
 	}
 	return nil
 }
 
+func (c *Control) FindCommit(args *string, reply *[]libcomb.Tag) (err error) {
+	//every tag the commit was mined at, including repeats
+	var commit [32]byte
+	if *node_mode == LIGHT_NODE {
+		return fmt.Errorf("not available on a light node")
+	}
+	if commit, err = parse_hex(*args); err != nil {
+		return err
+	}
+	*reply = db_find_commits(commit)
+	return nil
+}
+
 func (c *Control) GetCoinHistory(args *string, reply *string) (err error) {
 	var address [32]byte
 	if address, err = parse_hex(*args); err != nil {
 		return err
 	}
+	if *node_mode == LIGHT_NODE {
+		var history map[[32]byte]struct{}
+		if history, err = light_get_coin_history(address); err != nil {
+			return err
+		}
+		*reply = wallet_export_history(history)
+		return nil
+	}
 	*reply = wallet_export_history(libcomb.GetCoinHistory(address))
 	return nil
 }
@@ -379,20 +490,43 @@ func (c *Control) SaveWallet(args *struct{}, reply *string) (err error) {
 }
 
 func (c *Control) GetWallet(args *struct{}, reply *StringWallet) (err error) {
-	*reply = wallet_stringify()
-	return nil
+	*reply, err = wallet_stringify()
+	return err
 }
 
 type BlockReply struct {
-	Hash   string
-	Height int
+	Hash    string
+	Height  int
+	Rolling string
 }
 
 func (c *Control) GetBlockByHeight(args *int, reply *BlockReply) (err error) {
+	if *node_mode == LIGHT_NODE {
+		return fmt.Errorf("not available on a light node")
+	}
 	var height uint64 = uint64(*args)
 	var metadata BlockMetadata = db_get_block_by_height(height)
 	reply.Hash = stringify_hex(metadata.Hash)
 	reply.Height = int(metadata.Height)
+	reply.Rolling = stringify_hex(metadata.Rolling)
+	return nil
+}
+
+func (c *Control) GetBlockByHash(args *string, reply *BlockReply) (err error) {
+	if *node_mode == LIGHT_NODE {
+		return fmt.Errorf("not available on a light node")
+	}
+	var hash [32]byte
+	if hash, err = parse_hex(*args); err != nil {
+		return err
+	}
+	var metadata BlockMetadata
+	if metadata, err = db_get_block_by_hash(hash); err != nil {
+		return err
+	}
+	reply.Hash = stringify_hex(metadata.Hash)
+	reply.Height = int(metadata.Height)
+	reply.Rolling = stringify_hex(metadata.Rolling)
 	return nil
 }
 
@@ -401,21 +535,32 @@ type StatusInfo struct {
 	BTCHeight      uint64
 	BTCKnownHeight uint64
 	Commits        uint64
+	FinalHeight    uint64
+	Provisional    bool
 	Status         string
+	Alert          string
 	Network        string
 }
 
 func (c *Control) GetStatus(args *struct{}, reply *StatusInfo) (err error) {
+	NeoInfo.Lock.Lock()
 	reply.COMBHeight = COMBInfo.Height
+	reply.FinalHeight = neominer_final_height()
+	NeoInfo.Lock.Unlock()
+	reply.Provisional = neominer_has_provisional_commits()
 	reply.BTCHeight = BTC.Chain.Height
 	reply.BTCKnownHeight = BTC.Chain.KnownHeight
 	reply.Commits = libcomb.GetCommitCount()
 	reply.Status = COMBInfo.Status
+	reply.Alert = backend_get_alert()
 	reply.Network = COMBInfo.Network
 	return nil
 }
 
 func (c *Control) GetFingerprint(args *struct{}, reply *string) (err error) {
+	if *node_mode == LIGHT_NODE {
+		return fmt.Errorf("not available on a light node")
+	}
 	*reply = stringify_hex(db_compute_db_fingerprint())
 	return nil
 }
@@ -13,18 +13,23 @@ import (
 
 	"github.com/syndtr/goleveldb/leveldb"
 	"github.com/syndtr/goleveldb/leveldb/iterator"
-	"github.com/syndtr/goleveldb/leveldb/opt"
 	"github.com/syndtr/goleveldb/leveldb/util"
 )
 
 const DB_LEGACY_VERSION = 1
-const DB_CURRENT_VERSION = 2
+const DB_CURRENT_VERSION = 3
 
 const DB_VERSION_KEY_LENGTH = 2
 const DB_BLOCK_KEY_LENGTH = 8
 const DB_COMMIT_KEY_LENGTH = 16
+const DB_HASH_KEY_LENGTH = 33  //prefix(1),hash(32)
+const DB_INDEX_KEY_LENGTH = 49 //prefix(1),commit(32),tag(16)
 
-var db *leveldb.DB
+//the indexes live after all the block data, so height ranges never reach them
+const DB_HASH_PREFIX = 0xfe
+const DB_INDEX_PREFIX = 0xff
+
+var db Storage
 var db_is_new bool
 var db_mutex sync.Mutex
 
@@ -33,6 +38,8 @@ var DBInfo struct {
 	Version         uint16
 	CorruptedBlocks map[uint64]struct{}
 	Fingerprint     [32]byte
+	Index           bool
+	Tip             BlockMetadata //last block stored (or batched)
 }
 
 type BlockMetadata struct {
@@ -40,6 +47,7 @@ type BlockMetadata struct {
 	Hash        [32]byte `json:"hash"`
 	Previous    [32]byte `json:"previous"`
 	Fingerprint [32]byte `json:"fingerprint"`
+	Rolling     [32]byte `json:"rolling"` //fingerprint of every block up to and including this one
 }
 
 type Block struct {
@@ -60,9 +68,19 @@ func db_compute_block_fingerprint(commits [][32]byte) [32]byte {
 	return fingerprint
 }
 
+func db_compute_rolling_fingerprint(previous [32]byte, fingerprint [32]byte) [32]byte {
+	//chained, so two dbs have the same rolling fingerprint at a height only if they agree on every block up to it
+	var h hash.Hash = sha256.New()
+	var rolling [32]byte
+	h.Write(previous[:])
+	h.Write(fingerprint[:])
+	h.Sum(rolling[0:0])
+	return rolling
+}
+
 func db_compute_db_fingerprint() [32]byte {
 	var fingerprint [32]byte
-	iter := db.NewIterator(nil, nil)
+	iter := db.NewIterator(nil)
 	var key []byte
 	var value []byte
 	var metadata BlockMetadata
@@ -78,53 +96,54 @@ func db_compute_db_fingerprint() [32]byte {
 	return fingerprint
 }
 
-func db_find_commits(commit [32]byte) (out []uint64) {
-	var tmp [32]byte
-	var height uint64 = 0
-	iter := db.NewIterator(nil, nil)
-	for iok := iter.First(); iok; iok = iter.Next() {
-		if len(iter.Key()) == DB_BLOCK_KEY_LENGTH {
-			height = binary.BigEndian.Uint64(iter.Key())
-		}
-		if len(iter.Key()) == DB_COMMIT_KEY_LENGTH {
-			copy(tmp[:], iter.Value()[0:32])
-			if tmp == commit {
-				out = append(out, height)
+func db_find_commits(commit [32]byte) (out []libcomb.Tag) {
+	//every place a commit was mined, not just the first (which is all libcomb knows)
+	if DBInfo.Index {
+		var prefix [33]byte
+		prefix[0] = DB_INDEX_PREFIX
+		copy(prefix[1:], commit[:])
+		iter := db.NewIterator(util.BytesPrefix(prefix[:]))
+		for iter.Next() {
+			if len(iter.Key()) == DB_INDEX_KEY_LENGTH {
+				out = append(out, decode_tag(iter.Key()[33:]))
 			}
 		}
+		iter.Release()
+		return out
+	}
+
+	iter := db.NewIterator(nil)
+	for iok := iter.First(); iok; iok = iter.Next() {
+		if len(iter.Key()) == DB_COMMIT_KEY_LENGTH && decode_commit(iter.Value()) == commit {
+			out = append(out, decode_tag(iter.Key()))
+		}
 	}
 	iter.Release()
 	return out
 }
 
 func db_open() (err error) {
-	var lvldb *leveldb.DB
-	var options opt.Options
-	options.Compression = opt.NoCompression
-
-	path := COMBInfo.Path
-
-	//see if a db exists
-	options.ErrorIfMissing = true
-	lvldb, err = leveldb.OpenFile(path, &options)
-
-	if err != nil {
-		options.ErrorIfMissing = false
-		//may not exist, try create one
-		lvldb, err = leveldb.OpenFile(path, &options)
-		if err == nil {
-			db_is_new = true
-		} else {
-			//actually was some other error
-			return err
-		}
+	var storage *LevelStorage
+	var is_new bool
+	if storage, is_new, err = storage_open_level(COMBInfo.Path); err != nil {
+		return err
+	}
+	if is_new {
+		db_is_new = true
 	}
 
 	db_mutex.Lock()
-	db = lvldb
+	db = storage
 	return nil
 }
 
+func db_open_memory() {
+	//a db that never touches the disk, its gone once closed
+	db_mutex.Lock()
+	db = storage_new_memory()
+	db_is_new = true
+}
+
 func db_close() {
 	db.Close()
 	db = nil
@@ -133,9 +152,7 @@ func db_close() {
 
 func db_write(batch *leveldb.Batch) (err error) {
 	critical.Lock()
-	err = db.Write(batch, &opt.WriteOptions{
-		Sync: true,
-	})
+	err = db.Write(batch)
 	batch.Reset()
 	critical.Unlock()
 	return err
@@ -158,24 +175,41 @@ func encode_tag(tag libcomb.Tag) (data [16]byte) {
 	return data
 }
 
+func encode_index(commit [32]byte, tag [16]byte) (key [DB_INDEX_KEY_LENGTH]byte) {
+	key[0] = DB_INDEX_PREFIX
+	copy(key[1:33], commit[:])
+	copy(key[33:49], tag[:])
+	return key
+}
+
+func encode_hash(hash [32]byte) (key [DB_HASH_KEY_LENGTH]byte) {
+	key[0] = DB_HASH_PREFIX
+	copy(key[1:33], hash[:])
+	return key
+}
+
 func decode_block_metadata(key []byte, value []byte) (block BlockMetadata) {
 	block.Height = binary.BigEndian.Uint64(key[0:8])
 	copy(block.Hash[:], value[0:32])
 	copy(block.Previous[:], value[32:64])
 	copy(block.Fingerprint[:], value[64:96])
+	if len(value) >= 128 { //not in version 2 and older
+		copy(block.Rolling[:], value[96:128])
+	}
 	return block
 }
 
-func encode_block_metadata(data BlockMetadata) (key [8]byte, value [96]byte) {
+func encode_block_metadata(data BlockMetadata) (key [8]byte, value [128]byte) {
 	binary.BigEndian.PutUint64(key[0:8], data.Height)
 	copy(value[0:32], data.Hash[:])
 	copy(value[32:64], data.Previous[:])
 	copy(value[64:96], data.Fingerprint[:])
+	copy(value[96:128], data.Rolling[:])
 	return key, value
 }
 
 func db_inspect() {
-	iter := db.NewIterator(nil, nil)
+	iter := db.NewIterator(nil)
 
 	var sizes map[uint16]uint64 = make(map[uint16]uint64)
 
@@ -198,24 +232,15 @@ func db_inspect() {
 func db_get_version() uint16 {
 	var key [2]byte
 	var version uint16 = 1
-	if data, err := db.Get(key[:], nil); err == nil {
+	if data, err := db.Get(key[:]); err == nil {
 		version = binary.BigEndian.Uint16(data)
 	}
 	return version
 }
 
 func db_debug_remove_after(height uint64) {
-	var start_key [8]byte = uint64_to_bytes(height)
 	batch := new(leveldb.Batch)
-	iter := db.NewIterator(nil, nil)
-	if iter.Seek(start_key[:]) {
-		batch.Delete(iter.Key())
-		for iter.Next() {
-			batch.Delete(iter.Key())
-		}
-	}
-
-	iter.Release()
+	db_remove_range(batch, height)
 	db_write(batch)
 }
 
@@ -224,7 +249,7 @@ func db_debug_corrupt_after(height uint64) {
 	for {
 		if rand.Float64() < 0.5 {
 			var key [8]byte = uint64_to_bytes(height)
-			if value, err := db.Get(key[:], nil); err == nil {
+			if value, err := db.Get(key[:]); err == nil {
 				value[0] = 0
 				batch.Put(key[:], value)
 			} else {
@@ -244,20 +269,50 @@ func db_store_block(batch *leveldb.Batch, block *Block) (err error) {
 	for _, commit := range block.Commits {
 		tag_data := encode_tag(current_tag)
 		batch.Put(tag_data[:], commit[:])
+		if DBInfo.Index {
+			index_key := encode_index(commit, tag_data)
+			batch.Put(index_key[:], nil)
+		}
 		current_tag.Order++
 	}
 
+	//blocks are stored in order, so the parent is almost always the last one stored (the chain start has no rolling fingerprint)
+	if DBInfo.Tip.Hash != block.Metadata.Previous {
+		if DBInfo.Tip = db_get_block_by_height(block.Metadata.Height - 1); DBInfo.Tip.Hash != block.Metadata.Previous {
+			DBInfo.Tip = BlockMetadata{}
+		}
+	}
+	block.Metadata.Rolling = db_compute_rolling_fingerprint(DBInfo.Tip.Rolling, block.Metadata.Fingerprint)
+	DBInfo.Tip = block.Metadata
+
 	key, data := encode_block_metadata(block.Metadata)
 	batch.Put(key[:], data[:])
+	hash_key := encode_hash(block.Metadata.Hash)
+	batch.Put(hash_key[:], key[:])
 	return err
 }
 
+func db_remove_key(batch *leveldb.Batch, key []byte, value []byte) {
+	//blocks and commits take their index entries with them
+	if len(key) == DB_BLOCK_KEY_LENGTH {
+		hash_key := encode_hash(decode_block_metadata(key, value).Hash)
+		batch.Delete(hash_key[:])
+	}
+	if DBInfo.Index && len(key) == DB_COMMIT_KEY_LENGTH {
+		var tag [16]byte
+		copy(tag[:], key)
+		index_key := encode_index(decode_commit(value), tag)
+		batch.Delete(index_key[:])
+	}
+	batch.Delete(key)
+}
+
 func db_remove_block(batch *leveldb.Batch, height uint64) (err error) {
 	var prefix [8]byte
 	binary.BigEndian.PutUint64(prefix[:], height)
-	iter := db.NewIterator(util.BytesPrefix(prefix[:]), nil)
+	iter := db.NewIterator(util.BytesPrefix(prefix[:]))
 	for iter.Next() {
-		batch.Delete(iter.Key())
+		db_remove_key(batch, iter.Key(), iter.Value())
 	}
 	iter.Release()
 	if err = iter.Error(); err != nil {
@@ -266,19 +321,21 @@ func db_remove_block(batch *leveldb.Batch, height uint64) (err error) {
 	return nil
 }
 
-func db_remove_blocks_after(height uint64) (err error) {
-	var batch *leveldb.Batch = new(leveldb.Batch)
-	var prefix [8]byte
-	binary.BigEndian.PutUint64(prefix[:], height)
-	iter := db.NewIterator(nil, nil)
-	if iter.Seek(prefix[:]) {
-		batch.Delete(iter.Key())
-		for iter.Next() {
-			batch.Delete(iter.Key())
-		}
+func db_remove_range(batch *leveldb.Batch, height uint64) (err error) {
+	//every block from height onwards, the index is only touched through db_remove_key
+	var start [8]byte
+	binary.BigEndian.PutUint64(start[:], height)
+	iter := db.NewIterator(&util.Range{Start: start[:], Limit: []byte{DB_HASH_PREFIX}})
+	for iter.Next() {
+		db_remove_key(batch, iter.Key(), iter.Value())
 	}
 	iter.Release()
-	if err = iter.Error(); err != nil {
+	return iter.Error()
+}
+
+func db_remove_blocks_after(height uint64) (err error) {
+	var batch *leveldb.Batch = new(leveldb.Batch)
+	if err = db_remove_range(batch, height); err != nil {
 		return err
 	}
 	db_write(batch)
@@ -296,34 +353,55 @@ func db_process_block(batch *leveldb.Batch, block Block) (err error) {
 	return nil
 }
 
-func db_get_block_by_hash(hash [32]byte) (metadata BlockMetadata) {
-	iter := db.NewIterator(nil, nil)
+func db_get_block_by_hash(hash [32]byte) (metadata BlockMetadata, err error) {
+	hash_key := encode_hash(hash)
 	var key []byte
-	var value []byte
-	// iterate in reverse, it will be faster most of the time
-	for iter.Last(); iter.Valid(); iter.Prev() {
+	if key, err = db.Get(hash_key[:]); err != nil {
+		if err == leveldb.ErrNotFound {
+			return metadata, fmt.Errorf("block %X not found", hash)
+		}
+		return metadata, err
+	}
+	if len(key) != DB_BLOCK_KEY_LENGTH {
+		return metadata, fmt.Errorf("block %X has a corrupt index entry", hash)
+	}
+	if metadata = db_get_block_by_height(binary.BigEndian.Uint64(key)); metadata.Hash != hash {
+		return BlockMetadata{}, fmt.Errorf("block %X not found", hash)
+	}
+	return metadata, nil
+}
+
+func db_check_hash_index() {
+	//older dbs dont have the hash index, build it once from the stored blocks
+	var marker []byte = []byte{DB_HASH_PREFIX}
+	if built, _ := db.Has(marker); built {
+		return
+	}
+	log.Printf("(db) building block hash index...\n")
+	batch := new(leveldb.Batch)
+	iter := db.NewIterator(&util.Range{Limit: marker})
+	for iter.Next() {
 		if len(iter.Key()) == DB_BLOCK_KEY_LENGTH {
-			key = iter.Key()
-			value = iter.Value()
-			metadata = decode_block_metadata(key, value)
-			if metadata.Hash == hash {
-				break
-			}
+			hash_key := encode_hash(decode_block_metadata(iter.Key(), iter.Value()).Hash)
+			batch.Put(hash_key[:], append([]byte{}, iter.Key()...))
 		}
 	}
 	iter.Release()
-	return metadata
+	batch.Put(marker, nil)
+	if err := db_write(batch); err != nil {
+		log.Panicf("(db) block hash index update failed (%s)\n", err.Error())
+	}
 }
 
 func db_get_block_by_height(height uint64) (metadata BlockMetadata) {
 	var seek_key [8]byte
 	binary.BigEndian.PutUint64(seek_key[0:8], height)
 
-	iter := db.NewIterator(nil, nil)
+	iter := db.NewIterator(nil)
 	var key []byte
 	var value []byte
 
-	if ok := iter.Seek(seek_key[:]); ok {
+	if ok := iter.Seek(seek_key[:]); ok && len(iter.Key()) == DB_BLOCK_KEY_LENGTH {
 		key = iter.Key()
 		value = iter.Value()
 		metadata = decode_block_metadata(key, value)
@@ -334,15 +412,28 @@ func db_get_block_by_height(height uint64) (metadata BlockMetadata) {
 	return metadata
 }
 
+func db_get_last_block() (metadata BlockMetadata) {
+	//the highest stored block, block keys sort by height and everything after them is an index
+	iter := db.NewIterator(&util.Range{Limit: []byte{DB_HASH_PREFIX}})
+	for ok := iter.Last(); ok; ok = iter.Prev() {
+		if len(iter.Key()) == DB_BLOCK_KEY_LENGTH {
+			metadata = decode_block_metadata(iter.Key(), iter.Value())
+			break
+		}
+	}
+	iter.Release()
+	return metadata
+}
+
 func db_get_full_block_by_height(height uint64) (block BlockData) {
 	var seek_key [8]byte
 	binary.BigEndian.PutUint64(seek_key[0:8], height)
 
-	iter := db.NewIterator(nil, nil)
+	iter := db.NewIterator(nil)
 	var key []byte
 	var value []byte
 
-	if ok := iter.Seek(seek_key[:]); ok {
+	if ok := iter.Seek(seek_key[:]); ok && len(iter.Key()) == DB_BLOCK_KEY_LENGTH {
 		key = iter.Key()
 		value = iter.Value()
 		metadata := decode_block_metadata(key, value)
@@ -382,8 +473,12 @@ func db_load_blocks(start, end uint64, out chan<- Block) {
 
 	binary.BigEndian.PutUint64(start_bytes[:], start)
 	binary.BigEndian.PutUint64(end_bytes[:], end+1)
+	var limit []byte = end_bytes[:]
+	if end_bytes[0] >= DB_HASH_PREFIX {
+		limit = []byte{DB_HASH_PREFIX} //skip the indexes
+	}
 
-	iter = db.NewIterator(&util.Range{Start: start_bytes[:], Limit: end_bytes[:]}, nil)
+	iter = db.NewIterator(&util.Range{Start: start_bytes[:], Limit: limit})
 
 	for iter.Next() {
 		key = iter.Key()
@@ -406,47 +501,34 @@ func db_load_blocks(start, end uint64, out chan<- Block) {
 }
 
 func db_load() {
-	var blocks chan Block = make(chan Block)
 	var count uint64
-	var wait sync.Mutex
-	wait.Lock()
-	go func() {
-		var corruption_height uint64
-		defer func(){
-			if r := recover(); r != nil {
-				// Empty the remaining load queue
-				for discard := range blocks {
-					// Lol it seems like this is irrelevant
-					fmt.Println("discarding:", discard)
-				}
-				wait.Unlock()
-
-				// Remove blocks from DB
-				if corruption_height == 0 {
-					// Big problem if the whole chain is really corrupted, for now assume coding error
-					log.Panic("Corruption height 0!!!")
-				}
-				db_remove_blocks_after(corruption_height)
+	first, corrupted := db_check_blocks(func(block Block) {
+		combcore_process_block(block)
+		count++
+	})
+	log.Printf("(db) loaded %d blocks\n", count)
 
-			}
-		}()
-		for block := range blocks {
-			var fingerprint [32]byte = db_compute_block_fingerprint(block.Commits)
-			if block.Metadata.Fingerprint != fingerprint {
-				corruption_height = block.Metadata.Height
-				//recovery not implemented yet
-				log.Panicf("(db) fingerprint mismatch on block %d (%X != %X)\n", block.Metadata.Height, block.Metadata.Fingerprint, fingerprint)
-				// For now consider this block and all others after it corrupted, remove and let the rest of the program fix it I guess
-			}
-			combcore_process_block(block)
-			count++
+	//libcomb stopped at the block before the corruption, so dropping the rest leaves everything in step
+	if corrupted {
+		log.Printf("(db) %d corrupted blocks, resyncing from %d\n", len(DBInfo.CorruptedBlocks), first)
+		if err := db_truncate(first); err != nil {
+			log.Panicf("(db) cannot remove corrupted blocks (%s)\n", err.Error())
 		}
-		wait.Unlock()
-	}()
-	db_load_blocks(0, (^uint64(0))-1, blocks)
-	wait.Lock()
+	}
+}
 
-	log.Printf("(db) loaded %d blocks\n", count)
+func db_check_checkpoints() error {
+	//the stored chain has to go through every checkpoint it reaches
+	for height, hash := range COMBInfo.Checkpoint {
+		var metadata BlockMetadata = db_get_block_by_height(height)
+		if metadata.Height != height {
+			continue //not stored (yet)
+		}
+		if metadata.Hash != hash {
+			return fmt.Errorf("block %d is %X, expected checkpoint %X", height, metadata.Hash, hash)
+		}
+	}
+	return nil
 }
 
 func db_new() {
@@ -457,9 +539,12 @@ func db_new() {
 	batch.Put(key[:], value[:])
 	db_write(batch)
 	DBInfo.Version = DB_CURRENT_VERSION
+	db_check_hash_index()
+	db_check_index()
 }
 
 func db_start() {
+	DBInfo.Tip = BlockMetadata{}
 	if db_is_new {
 		log.Printf("(db) new database created (version %d)\n", DB_CURRENT_VERSION)
 		db_new()
@@ -470,10 +555,82 @@ func db_start() {
 
 	DBInfo.Version = db_get_version()
 	if DBInfo.Version != DB_CURRENT_VERSION {
-		log.Panicln("(db) cannot load legacy db")
+		if err := db_migrate(); err != nil {
+			log.Panicf("(db) cannot load version %d db (%s)\n", DBInfo.Version, err.Error())
+		}
 	}
 
+	if err := db_check_checkpoints(); err != nil {
+		log.Panicf("(db) refusing to load (%s)\n", err.Error())
+	}
+
+	db_check_hash_index()
+	db_check_index()
+
 	DBInfo.InitialLoad = true
 	db_load()
 	DBInfo.InitialLoad = false
 }
+
+func db_open_offline() (err error) {
+	//for the commands that work on the db without starting the node, same as db_start minus loading
+	if err = db_open(); err != nil {
+		return err
+	}
+	DBInfo.Tip = BlockMetadata{}
+	if db_is_new {
+		db_new()
+		return nil
+	}
+	if DBInfo.Version = db_get_version(); DBInfo.Version != DB_CURRENT_VERSION {
+		if err = db_migrate(); err != nil {
+			db_close()
+			return err
+		}
+	}
+	db_check_hash_index()
+	db_check_index()
+	return nil
+}
+
+func db_check_index() {
+	//build the commit index if its wanted, or drop it if not (it would go stale)
+	var marker []byte = []byte{DB_INDEX_PREFIX}
+	built, _ := db.Has(marker)
+	if built == *comb_fingerprint_index {
+		DBInfo.Index = built
+		return
+	}
+
+	batch := new(leveldb.Batch)
+	if *comb_fingerprint_index {
+		log.Printf("(db) building commit index...\n")
+		iter := db.NewIterator(&util.Range{Limit: []byte{DB_HASH_PREFIX}})
+		for iter.Next() {
+			if len(iter.Key()) == DB_COMMIT_KEY_LENGTH {
+				var tag [16]byte
+				copy(tag[:], iter.Key())
+				index_key := encode_index(decode_commit(iter.Value()), tag)
+				batch.Put(index_key[:], nil)
+			}
+			if batch.Len() >= 100000 { //dont hold the whole index in memory
+				if err := db_write(batch); err != nil {
+					log.Panicf("(db) commit index update failed (%s)\n", err.Error())
+				}
+			}
+		}
+		iter.Release()
+		batch.Put(marker, nil)
+	} else {
+		log.Printf("(db) removing commit index...\n")
+		iter := db.NewIterator(util.BytesPrefix(marker))
+		for iter.Next() {
+			batch.Delete(iter.Key())
+		}
+		iter.Release()
+	}
+	if err := db_write(batch); err != nil {
+		log.Panicf("(db) commit index update failed (%s)\n", err.Error())
+	}
+	DBInfo.Index = *comb_fingerprint_index
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+//upgrades older databases in place, one version at a time, instead of resyncing from bitcoin
+
+const DB_MIGRATE_PROGRESS = 100000
+
+var DB_MIGRATIONS = map[uint16]func(tr StorageTransaction) error{
+	//version -> step that upgrades it to the next version
+	DB_LEGACY_VERSION: db_migrate_v1,
+	2:                 db_migrate_v2,
+}
+
+func db_migrate() (err error) {
+	if DBInfo.Version > DB_CURRENT_VERSION {
+		return fmt.Errorf("version %d is newer than this build supports (%d)", DBInfo.Version, DB_CURRENT_VERSION)
+	}
+	for version := DBInfo.Version; version < DB_CURRENT_VERSION; version++ {
+		if _, ok := DB_MIGRATIONS[version]; !ok {
+			return fmt.Errorf("no migration from version %d", version)
+		}
+	}
+
+	if *comb_db_backup {
+		var backup string = fmt.Sprintf("%s.v%d.bak", filepath.Clean(COMBInfo.Path), DBInfo.Version)
+		log.Printf("(db) backing up to %s...\n", backup)
+		//goleveldb recovers its journal and compacts in the background while open, so copy it closed
+		db_close()
+		err = db_backup(COMBInfo.Path, backup)
+		if reopen := db_open(); reopen != nil {
+			return fmt.Errorf("reopen after backup failed (%s)", reopen.Error())
+		}
+		if err != nil {
+			return fmt.Errorf("backup failed (%s)", err.Error())
+		}
+	}
+
+	for DBInfo.Version < DB_CURRENT_VERSION {
+		log.Printf("(db) migrating from version %d to %d...\n", DBInfo.Version, DBInfo.Version+1)
+		combcore_set_status(fmt.Sprintf("Migrating database (v%d)...", DBInfo.Version))
+
+		//each step commits in one go with its version bump, so a crash leaves the old version intact
+		var tr StorageTransaction
+		if tr, err = db.OpenTransaction(); err != nil {
+			return err
+		}
+		if err = DB_MIGRATIONS[DBInfo.Version](tr); err != nil {
+			tr.Discard()
+			return fmt.Errorf("migration from version %d failed (%s)", DBInfo.Version, err.Error())
+		}
+		var key [DB_VERSION_KEY_LENGTH]byte
+		var value [2]byte
+		binary.BigEndian.PutUint16(value[:], DBInfo.Version+1)
+		if err = tr.Put(key[:], value[:]); err != nil {
+			tr.Discard()
+			return err
+		}
+		if err = tr.Commit(); err != nil {
+			return err
+		}
+		DBInfo.Version++
+	}
+	log.Printf("(db) migrated to version %d\n", DBInfo.Version)
+	return nil
+}
+
+func db_migrate_progress(keys uint64) {
+	if keys%DB_MIGRATE_PROGRESS == 0 {
+		log.Printf("(db) migrated %d keys...\n", keys)
+	}
+}
+
+func db_migrate_v1(tr StorageTransaction) (err error) {
+	//v1 is told apart by having no version key, its blocks and commits can only be read if they match the v2 rows (96 and 32 bytes)
+	//rows that dont are refused rather than guessed at, anything else is dropped (the indexes get rebuilt), and so is everything from the first block that fails its fingerprint (it gets mined again)
+	var keys uint64
+	var block BlockMetadata
+	var commits [][32]byte
+	var loaded bool
+	var bad bool
+	var bad_height uint64
+	var check = func() {
+		if loaded && !bad && block.Fingerprint != db_compute_block_fingerprint(commits) {
+			bad, bad_height = true, block.Height
+		}
+	}
+
+	iter := tr.NewIterator(nil)
+	for iter.Next() {
+		keys++
+		db_migrate_progress(keys)
+		switch len(iter.Key()) {
+		case DB_BLOCK_KEY_LENGTH:
+			if len(iter.Value()) != 96 {
+				iter.Release()
+				return fmt.Errorf("block row %X is %d bytes, expected 96", iter.Key(), len(iter.Value()))
+			}
+			check()
+			block = decode_block_metadata(iter.Key(), iter.Value())
+			commits = nil
+			loaded = true
+		case DB_COMMIT_KEY_LENGTH:
+			if len(iter.Value()) != 32 {
+				iter.Release()
+				return fmt.Errorf("commit row %X is %d bytes, expected 32", iter.Key(), len(iter.Value()))
+			}
+			commits = append(commits, decode_commit(iter.Value()))
+		default:
+			if err = tr.Delete(iter.Key()); err != nil {
+				iter.Release()
+				return err
+			}
+		}
+	}
+	check()
+	iter.Release()
+	if err = iter.Error(); err != nil {
+		return err
+	}
+
+	if bad {
+		log.Printf("(db) block %d fails its fingerprint, dropping it and everything after\n", bad_height)
+		var start [8]byte = uint64_to_bytes(bad_height)
+		iter = tr.NewIterator(&util.Range{Start: start[:], Limit: []byte{DB_HASH_PREFIX}})
+		for iter.Next() {
+			if err = tr.Delete(iter.Key()); err != nil {
+				break
+			}
+		}
+		iter.Release()
+		if err != nil {
+			return err
+		}
+		return iter.Error()
+	}
+	return nil
+}
+
+func db_migrate_v2(tr StorageTransaction) (err error) {
+	//v3 adds the rolling fingerprint to every block, computed in height order
+	var keys uint64
+	var parent BlockMetadata
+	iter := tr.NewIterator(nil)
+	for iter.Next() {
+		if len(iter.Key()) != DB_BLOCK_KEY_LENGTH {
+			continue
+		}
+		keys++
+		db_migrate_progress(keys)
+		var block BlockMetadata = decode_block_metadata(iter.Key(), iter.Value())
+		if parent.Hash != block.Previous {
+			parent = BlockMetadata{} //the chain start
+		}
+		block.Rolling = db_compute_rolling_fingerprint(parent.Rolling, block.Fingerprint)
+		key, value := encode_block_metadata(block)
+		if err = tr.Put(key[:], value[:]); err != nil {
+			break
+		}
+		parent = block
+	}
+	iter.Release()
+	if err != nil {
+		return err
+	}
+	return iter.Error()
+}
+
+func db_backup(path string, backup string) (err error) {
+	//the db has to be closed, then a plain copy of the files is consistent
+	if _, err = os.Stat(backup); err == nil {
+		return fmt.Errorf("%s already exists", backup)
+	}
+	var files []string
+	if files, err = filepath.Glob(filepath.Join(path, "*")); err != nil {
+		return err
+	}
+	if err = os.MkdirAll(backup, 0755); err != nil {
+		return err
+	}
+	for _, file := range files {
+		if filepath.Base(file) == "LOCK" {
+			continue
+		}
+		if err = db_backup_file(file, filepath.Join(backup, filepath.Base(file))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func db_backup_file(from string, to string) (err error) {
+	var in, out *os.File
+	if in, err = os.Open(from); err != nil {
+		return err
+	}
+	defer in.Close()
+	if out, err = os.Create(to); err != nil {
+		return err
+	}
+	if _, err = io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+//finds corrupted blocks and truncates the db before the first one, sync then mines them again
+
+func db_check_link(block Block, parent BlockMetadata) error {
+	if block.Metadata.Height != parent.Height+1 {
+		return fmt.Errorf("expected block %d", parent.Height+1)
+	}
+	if block.Metadata.Previous != parent.Hash {
+		return fmt.Errorf("previous is %X, expected %X", block.Metadata.Previous, parent.Hash)
+	}
+	return nil
+}
+
+func db_check_contents(block Block, parent BlockMetadata) error {
+	if fingerprint := db_compute_block_fingerprint(block.Commits); block.Metadata.Fingerprint != fingerprint {
+		return fmt.Errorf("fingerprint mismatch (%X != %X)", block.Metadata.Fingerprint, fingerprint)
+	}
+	if rolling := db_compute_rolling_fingerprint(parent.Rolling, block.Metadata.Fingerprint); block.Metadata.Rolling != rolling {
+		return fmt.Errorf("rolling fingerprint mismatch (%X != %X)", block.Metadata.Rolling, rolling)
+	}
+	return combcore_check_checkpoint(block.Metadata.Height, block.Metadata.Hash)
+}
+
+func db_check_block(block Block, parent BlockMetadata) error {
+	if err := db_check_link(block, parent); err != nil {
+		return err
+	}
+	return db_check_contents(block, parent)
+}
+
+func db_check_blocks(process func(block Block)) (first uint64, corrupted bool) {
+	//every block is checked, but only the ones before the first corrupted block are processed
+	//a blocks own hash is only checked by the next blocks previous, so each block is held back until its child links to it
+	var blocks chan Block = make(chan Block)
+	go db_load_blocks(0, (^uint64(0))-1, blocks)
+
+	DBInfo.CorruptedBlocks = make(map[uint64]struct{})
+	var start uint64 = COMBInfo.Height
+	var parent BlockMetadata = BlockMetadata{Height: COMBInfo.Height, Hash: COMBInfo.Hash}
+	var held *Block
+	var mark = func(height uint64, reason string) {
+		log.Printf("(db) block %d is corrupted (%s)\n", height, reason)
+		DBInfo.CorruptedBlocks[height] = struct{}{}
+		if !corrupted {
+			first, corrupted = height, true
+		}
+	}
+	for block := range blocks {
+		if block.Metadata.Hash == empty {
+			continue //dummy block
+		}
+		if err := db_check_link(block, parent); err == nil || block.Metadata.Height != parent.Height+1 {
+			if held != nil && !corrupted && process != nil {
+				process(*held)
+			}
+			if err != nil {
+				mark(block.Metadata.Height, err.Error())
+			}
+		} else if parent.Height != start {
+			//either the parents hash or this previous is wrong, the parent cant be trusted either way
+			mark(parent.Height, fmt.Sprintf("hash %X doesnt match the previous of block %d (%X)", parent.Hash, block.Metadata.Height, block.Metadata.Previous))
+		} else {
+			mark(block.Metadata.Height, err.Error())
+		}
+		held = nil
+
+		if err := db_check_contents(block, parent); err != nil {
+			mark(block.Metadata.Height, err.Error())
+		}
+		if !corrupted {
+			held = &Block{Metadata: block.Metadata, Commits: block.Commits}
+		}
+		parent = block.Metadata
+	}
+	//the tip has no child to vouch for its hash
+	if held != nil && !corrupted && process != nil {
+		process(*held)
+	}
+	return first, corrupted
+}
+
+func db_truncate(height uint64) (err error) {
+	//corrupted rows may not decode back to their index entries, so the indexes are rebuilt rather than trimmed
+	log.Printf("(db) truncating at block %d...\n", height)
+	var batch *leveldb.Batch = new(leveldb.Batch)
+	if err = db_remove_range(batch, height); err != nil {
+		return err
+	}
+	iter := db.NewIterator(&util.Range{Start: []byte{DB_HASH_PREFIX}})
+	for iter.Next() {
+		batch.Delete(iter.Key())
+	}
+	iter.Release()
+	if err = iter.Error(); err != nil {
+		return err
+	}
+	if err = db_write(batch); err != nil {
+		return err
+	}
+	db_check_hash_index()
+	db_check_index()
+	return nil
+}
+
+func db_repair() (err error) {
+	//the repair command, checks the whole db and truncates it without loading or syncing anything
+	if err = db_open_offline(); err != nil {
+		return err
+	}
+	defer db_close()
+	if db_is_new {
+		return fmt.Errorf("no database at %s", COMBInfo.Path)
+	}
+
+	log.Printf("(db) checking blocks...\n")
+	first, corrupted := db_check_blocks(nil)
+	if !corrupted {
+		log.Printf("(db) no corrupted blocks found\n")
+		return nil
+	}
+	log.Printf("(db) found %d corrupted blocks, the first at %d\n", len(DBInfo.CorruptedBlocks), first)
+	return db_truncate(first)
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"os"
+	"strconv"
+
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+//snapshots of the commit db, so a new node can start from a trusted height instead of mining everything
+//header: magic(8),version(2),network(4),height(8),rolling(32)
+//blocks: key(8),metadata(128),commit count(4),commits(32 each)
+//trailer: sha256 of everything before it(32)
+
+const SNAPSHOT_MAGIC = "COMBSNAP"
+const SNAPSHOT_VERSION = 1
+const SNAPSHOT_HEADER_LENGTH = 54
+const SNAPSHOT_BATCH = 1000
+
+type SnapshotHeader struct {
+	Version uint16
+	Network uint32
+	Height  uint64
+	Rolling [32]byte
+}
+
+func snapshot_encode_header(header SnapshotHeader) (data [SNAPSHOT_HEADER_LENGTH]byte) {
+	copy(data[0:8], SNAPSHOT_MAGIC)
+	binary.BigEndian.PutUint16(data[8:10], header.Version)
+	binary.BigEndian.PutUint32(data[10:14], header.Network)
+	binary.BigEndian.PutUint64(data[14:22], header.Height)
+	copy(data[22:54], header.Rolling[:])
+	return data
+}
+
+func snapshot_decode_header(data []byte) (header SnapshotHeader, err error) {
+	if string(data[0:8]) != SNAPSHOT_MAGIC {
+		return header, fmt.Errorf("not a snapshot")
+	}
+	header.Version = binary.BigEndian.Uint16(data[8:10])
+	header.Network = binary.BigEndian.Uint32(data[10:14])
+	header.Height = binary.BigEndian.Uint64(data[14:22])
+	copy(header.Rolling[:], data[22:54])
+	return header, nil
+}
+
+func snapshot_export(path string, height_arg string) (err error) {
+	if path == "" {
+		return fmt.Errorf("usage: export-snapshot <file> [height]")
+	}
+	if err = db_open_offline(); err != nil {
+		return err
+	}
+	defer db_close()
+
+	//defaults to everything stored, which is only ever final blocks
+	var last BlockMetadata = db_get_last_block()
+	var height uint64 = last.Height
+	if height_arg != "" {
+		if height, err = strconv.ParseUint(height_arg, 10, 64); err != nil {
+			return err
+		}
+	}
+	var tip BlockMetadata = db_get_block_by_height(height)
+	if tip.Height != height || tip.Hash == empty {
+		return fmt.Errorf("block %d is not stored", height)
+	}
+
+	var f *os.File
+	if f, err = os.Create(path + ".tmp"); err != nil {
+		return err
+	}
+	defer os.Remove(path + ".tmp")
+	var checksum hash.Hash = sha256.New()
+	var buffer *bufio.Writer = bufio.NewWriter(f)
+	var w io.Writer = io.MultiWriter(buffer, checksum)
+
+	log.Printf("(snapshot) exporting blocks up to %d...\n", height)
+	var header [SNAPSHOT_HEADER_LENGTH]byte = snapshot_encode_header(SnapshotHeader{SNAPSHOT_VERSION, COMBInfo.Magic, height, tip.Rolling})
+	w.Write(header[:])
+
+	var blocks chan Block = make(chan Block)
+	go db_load_blocks(0, height, blocks)
+	for block := range blocks {
+		if block.Metadata.Hash == empty {
+			continue //dummy block
+		}
+		key, value := encode_block_metadata(block.Metadata)
+		var count [4]byte
+		binary.BigEndian.PutUint32(count[:], uint32(len(block.Commits)))
+		w.Write(key[:])
+		w.Write(value[:])
+		w.Write(count[:])
+		for _, commit := range block.Commits {
+			w.Write(commit[:])
+		}
+	}
+	buffer.Write(checksum.Sum(nil))
+	if err = buffer.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	if err = os.Rename(path+".tmp", path); err != nil {
+		return err
+	}
+	log.Printf("(snapshot) exported %d (rolling fingerprint %X)\n", height, tip.Rolling)
+	return nil
+}
+
+func snapshot_check_file(f *os.File) (err error) {
+	var stats os.FileInfo
+	if stats, err = f.Stat(); err != nil {
+		return err
+	}
+	if stats.Size() < SNAPSHOT_HEADER_LENGTH+32 {
+		return fmt.Errorf("snapshot is truncated")
+	}
+	var checksum hash.Hash = sha256.New()
+	if _, err = io.CopyN(checksum, f, stats.Size()-32); err != nil {
+		return err
+	}
+	var expected [32]byte
+	if _, err = io.ReadFull(f, expected[:]); err != nil {
+		return err
+	}
+	if string(checksum.Sum(nil)) != string(expected[:]) {
+		return fmt.Errorf("snapshot checksum mismatch")
+	}
+	_, err = f.Seek(0, io.SeekStart)
+	return err
+}
+
+func snapshot_read_block(r io.Reader) (block Block, err error) {
+	var data [DB_BLOCK_KEY_LENGTH + 128 + 4]byte
+	if _, err = io.ReadFull(r, data[:]); err != nil {
+		return block, err
+	}
+	block.Metadata = decode_block_metadata(data[0:8], data[8:136])
+	var count uint32 = binary.BigEndian.Uint32(data[136:140])
+	for i := uint32(0); i < count; i++ {
+		var commit [32]byte
+		if _, err = io.ReadFull(r, commit[:]); err != nil {
+			return block, err
+		}
+		block.Commits = append(block.Commits, commit)
+	}
+	return block, nil
+}
+
+func snapshot_import(path string, trusted_arg string) (err error) {
+	if path == "" || trusted_arg == "" {
+		return fmt.Errorf("usage: import-snapshot <file> <trusted rolling fingerprint>")
+	}
+	var trusted [32]byte
+	if trusted, err = parse_hex(trusted_arg); err != nil {
+		return err
+	}
+
+	var f *os.File
+	if f, err = os.Open(path); err != nil {
+		return err
+	}
+	defer f.Close()
+	if err = snapshot_check_file(f); err != nil {
+		return err
+	}
+	var r *bufio.Reader = bufio.NewReader(f)
+	var data [SNAPSHOT_HEADER_LENGTH]byte
+	if _, err = io.ReadFull(r, data[:]); err != nil {
+		return err
+	}
+	var header SnapshotHeader
+	if header, err = snapshot_decode_header(data[:]); err != nil {
+		return err
+	}
+	if header.Version != SNAPSHOT_VERSION {
+		return fmt.Errorf("snapshot version %d is not supported", header.Version)
+	}
+	if header.Network != COMBInfo.Magic {
+		return fmt.Errorf("snapshot is for another network")
+	}
+	if header.Rolling != trusted {
+		return fmt.Errorf("snapshot ends at %X, expected %X", header.Rolling, trusted)
+	}
+
+	if err = db_open_offline(); err != nil {
+		return err
+	}
+	defer db_close()
+	if last := db_get_last_block(); last.Hash != empty {
+		return fmt.Errorf("database already has blocks (up to %d)", last.Height)
+	}
+
+	//everything is checked from the chain start, and nothing is committed unless it all ends at the trusted fingerprint
+	log.Printf("(snapshot) importing blocks up to %d...\n", header.Height)
+	var tr StorageTransaction
+	if tr, err = db.OpenTransaction(); err != nil {
+		return err
+	}
+	var batch *leveldb.Batch = new(leveldb.Batch)
+	var parent BlockMetadata = BlockMetadata{Height: COMBInfo.Height, Hash: COMBInfo.Hash}
+	for parent.Height < header.Height {
+		var block Block
+		if block, err = snapshot_read_block(r); err != nil {
+			break
+		}
+		if err = db_check_block(block, parent); err != nil {
+			err = fmt.Errorf("block %d is invalid (%s)", block.Metadata.Height, err.Error())
+			break
+		}
+		if err = db_store_block(batch, &block); err != nil {
+			break
+		}
+		if batch.Len() >= SNAPSHOT_BATCH {
+			if err = tr.Write(batch); err != nil {
+				break
+			}
+			batch.Reset()
+		}
+		parent = block.Metadata
+	}
+	if err == nil && parent.Rolling != trusted {
+		err = fmt.Errorf("snapshot ends at %X, expected %X", parent.Rolling, trusted)
+	}
+	if err == nil {
+		err = tr.Write(batch)
+	}
+	if err != nil {
+		tr.Discard()
+		return err
+	}
+	if err = tr.Commit(); err != nil {
+		return err
+	}
+	log.Printf("(snapshot) imported %d blocks, syncing continues from %d\n", header.Height-COMBInfo.Height, header.Height)
+	return nil
+}
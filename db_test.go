@@ -0,0 +1,396 @@
+package main
+
+import (
+	"os"
+	"testing"
+
+	"libcomb"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+func db_test_check_index(t *testing.T, chain *MockChain) {
+	//the index has to agree with a full scan for every commit ever mined on any branch
+	t.Helper()
+	for _, commits := range chain.Commits {
+		for _, commit := range commits {
+			DBInfo.Index = true
+			var indexed = db_find_commits(commit)
+			DBInfo.Index = false
+			var scanned = db_find_commits(commit)
+			DBInfo.Index = true
+			if len(indexed) != len(scanned) {
+				t.Fatalf("commit %X indexed at %v, scanned at %v", commit, indexed, scanned)
+			}
+			for i := range indexed {
+				if indexed[i] != scanned[i] {
+					t.Fatalf("commit %X indexed at %v, scanned at %v", commit, indexed, scanned)
+				}
+			}
+		}
+	}
+}
+
+func TestCommitIndex(t *testing.T) {
+	*comb_fingerprint_index = true
+	defer func() { *comb_fingerprint_index = false }()
+
+	var chain *MockChain = sync_test_start(t, 2)
+	var a [][32]byte = mock_extend(chain, chain.Genesis, 30, 1)
+	btc_sync()
+	sync_test_check(t, chain, 2)
+	db_test_check_index(t, chain)
+
+	var commit [32]byte = chain.Commits[a[4]][0]
+	if tags := db_find_commits(commit); len(tags) != 1 || tags[0].Height != 5 {
+		t.Fatalf("commit %X found at %v", commit, tags)
+	}
+
+	//reorged commits have to leave the index too
+	mock_extend(chain, a[9], 25, 2)
+	btc_sync()
+	sync_test_check(t, chain, 2)
+	db_test_check_index(t, chain)
+	if tags := db_find_commits(chain.Commits[a[21]][0]); len(tags) != 0 {
+		t.Fatalf("reorged commit still found at %v", tags)
+	}
+}
+
+func TestCommitIndexRebuild(t *testing.T) {
+	var chain *MockChain = sync_test_start(t, 0)
+	mock_extend(chain, chain.Genesis, 20, 1)
+	btc_sync()
+
+	//turning the index on later builds it from whats stored, turning it off removes it
+	*comb_fingerprint_index = true
+	db_check_index()
+	db_test_check_index(t, chain)
+
+	*comb_fingerprint_index = false
+	db_check_index()
+	iter := db.NewIterator(nil)
+	for iter.Next() {
+		if iter.Key()[0] == DB_INDEX_PREFIX {
+			t.Fatalf("index key %X left behind", iter.Key())
+		}
+	}
+	iter.Release()
+}
+
+func TestBlockHashIndex(t *testing.T) {
+	var chain *MockChain = sync_test_start(t, 2)
+	var a [][32]byte = mock_extend(chain, chain.Genesis, 30, 1)
+	btc_sync()
+
+	//reorged blocks have to be reported missing, not as zero metadata
+	mock_extend(chain, a[9], 25, 2)
+	btc_sync()
+	sync_test_check(t, chain, 2)
+	if _, err := db_get_block_by_hash(a[20]); err == nil {
+		t.Fatalf("reorged block %X still found", a[20])
+	}
+
+	//older dbs get the index built on start
+	db.Delete([]byte{DB_HASH_PREFIX})
+	db_check_hash_index()
+	var best [][32]byte = mock_best_chain(chain)
+	for h := uint64(1); h <= neominer_final_height(); h++ {
+		if metadata, err := db_get_block_by_hash(best[h]); err != nil || metadata.Height != h {
+			t.Fatalf("block %X found at %d (%v), expected %d", best[h], metadata.Height, err, h)
+		}
+	}
+	if _, err := db_get_block_by_hash(chain.Tip); err == nil {
+		t.Fatal("provisional block was found in the db")
+	}
+}
+
+func db_test_write_v1(t *testing.T, path string, blocks []Block) {
+	//a v1 db: 96 byte block rows and their commits, no version key and no indexes
+	v1, err := leveldb.OpenFile(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	batch := new(leveldb.Batch)
+	for _, block := range blocks {
+		for i, commit := range block.Commits {
+			var tag [16]byte = encode_tag(libcomb.Tag{Height: block.Metadata.Height, Order: uint32(i)})
+			batch.Put(tag[:], commit[:])
+		}
+		key, value := encode_block_metadata(block.Metadata)
+		batch.Put(key[:], value[:96])
+	}
+	batch.Put([]byte{1, 2, 3}, nil) //a row v2 doesnt know
+	if err = v1.Write(batch, nil); err != nil {
+		t.Fatal(err)
+	}
+	v1.Close()
+}
+
+func TestMigrateLegacy(t *testing.T) {
+	*comb_fingerprint_index = true
+	defer func() { *comb_fingerprint_index = false }()
+	var chain *MockChain = sync_test_start(t, 0)
+	mock_extend(chain, chain.Genesis, 20, 1)
+	btc_sync()
+	var stored []Block
+	var out chan Block = make(chan Block)
+	go db_load_blocks(1, 20, out)
+	for block := range out {
+		if block.Metadata.Hash != empty {
+			stored = append(stored, block)
+		}
+	}
+
+	//the same chain written by v1, with block 15 failing its fingerprint
+	db_close()
+	var path string = t.TempDir()
+	var legacy []Block = make([]Block, len(stored))
+	copy(legacy, stored)
+	legacy[14].Metadata.Fingerprint[0] ^= 1
+	db_test_write_v1(t, path, legacy)
+
+	*comb_db_backup = true
+	defer func() { *comb_db_backup = false }()
+	sync_test_load(t, path)
+	if db_get_version() != DB_CURRENT_VERSION {
+		t.Fatalf("db is at version %d after migrating", db_get_version())
+	}
+	if ok, _ := db.Has([]byte{1, 2, 3}); ok {
+		t.Fatal("unknown row survived the migration")
+	}
+	if _, err := os.Stat(path + ".v1.bak/CURRENT"); err != nil {
+		t.Fatalf("no backup (%s)", err.Error())
+	}
+
+	//good blocks get the same rolling fingerprints a v3 node would have, and the indexes are built on start
+	for _, block := range stored[:14] {
+		if metadata, err := db_get_block_by_hash(block.Metadata.Hash); err != nil || metadata != block.Metadata {
+			t.Fatalf("block %d migrated to %+v (%v), expected %+v", block.Metadata.Height, metadata, err, block.Metadata)
+		}
+	}
+	if metadata := db_get_block_by_height(15); metadata.Height != 0 {
+		t.Fatal("bad block survived the migration")
+	}
+	if COMBInfo.Height != 14 {
+		t.Fatalf("loaded to %d, expected 14", COMBInfo.Height)
+	}
+	db_test_check_index(t, chain)
+
+	//and the dropped blocks are mined again
+	btc_sync()
+	sync_test_check(t, chain, 0)
+}
+
+func TestMigrateUnknownLayout(t *testing.T) {
+	//rows v1 never wrote are refused, not misread
+	var chain *MockChain = sync_test_start(t, 0)
+	mock_extend(chain, chain.Genesis, 5, 1)
+	btc_sync()
+	var version [DB_VERSION_KEY_LENGTH]byte
+	db.Delete(version[:])
+	DBInfo.Version = db_get_version()
+	if err := db_migrate(); err == nil {
+		t.Fatal("128 byte block rows were migrated as v1")
+	}
+	if db_get_version() != DB_LEGACY_VERSION {
+		t.Fatal("failed migration changed the version")
+	}
+}
+
+func db_test_corrupt(t *testing.T) {
+	//a bad fingerprint on block 12 and a bad commit in block 17
+	var key [8]byte = uint64_to_bytes(12)
+	value, _ := db.Get(key[:])
+	value[64] ^= 1
+	db.Put(key[:], value)
+
+	key = uint64_to_bytes(17)
+	iter := db.NewIterator(util.BytesPrefix(key[:]))
+	for iter.Next() {
+		if len(iter.Key()) == DB_COMMIT_KEY_LENGTH {
+			db.Put(append([]byte{}, iter.Key()...), make([]byte, 32))
+			break
+		}
+	}
+	iter.Release()
+}
+
+func db_test_check_corrupted(t *testing.T) {
+	t.Helper()
+	if len(DBInfo.CorruptedBlocks) != 2 {
+		t.Fatalf("found corrupted blocks %v, expected 12 and 17", DBInfo.CorruptedBlocks)
+	}
+	for _, height := range []uint64{12, 17} {
+		if _, ok := DBInfo.CorruptedBlocks[height]; !ok {
+			t.Fatalf("block %d not found corrupted", height)
+		}
+	}
+	if metadata := db_get_block_by_height(12); metadata.Height != 0 {
+		t.Fatal("corrupted block was not removed")
+	}
+}
+
+func TestCorruptionRecovery(t *testing.T) {
+	var chain *MockChain = sync_test_start(t, 0)
+	mock_extend(chain, chain.Genesis, 20, 1)
+	btc_sync()
+	db_test_corrupt(t)
+
+	//loading stops before the first corrupted block, and sync mines everything after it again
+	var path string = COMBInfo.Path
+	db_close()
+	sync_test_load(t, path)
+	db_test_check_corrupted(t)
+	if COMBInfo.Height != 11 || libcomb.GetHeight() != 11 {
+		t.Fatalf("loaded to %d (libcomb %d), expected 11", COMBInfo.Height, libcomb.GetHeight())
+	}
+	btc_sync()
+	sync_test_check(t, chain, 0)
+}
+
+func TestCorruptedHash(t *testing.T) {
+	var chain *MockChain = sync_test_start(t, 0)
+	mock_extend(chain, chain.Genesis, 20, 1)
+	btc_sync()
+
+	//like db_debug_corrupt_after, only the next blocks previous shows the hash is wrong
+	var key [8]byte = uint64_to_bytes(12)
+	value, _ := db.Get(key[:])
+	value[0] ^= 1
+	db.Put(key[:], value)
+
+	var path string = COMBInfo.Path
+	db_close()
+	sync_test_load(t, path)
+	if _, ok := DBInfo.CorruptedBlocks[12]; !ok || len(DBInfo.CorruptedBlocks) != 1 {
+		t.Fatalf("found corrupted blocks %v, expected 12", DBInfo.CorruptedBlocks)
+	}
+	if COMBInfo.Height != 11 || libcomb.GetHeight() != 11 {
+		t.Fatalf("loaded to %d (libcomb %d), expected 11", COMBInfo.Height, libcomb.GetHeight())
+	}
+	if metadata := db_get_block_by_height(12); metadata.Height != 0 {
+		t.Fatal("corrupted block was not removed")
+	}
+	btc_sync()
+	sync_test_check(t, chain, 0)
+}
+
+func TestRepair(t *testing.T) {
+	var chain *MockChain = sync_test_start(t, 0)
+	mock_extend(chain, chain.Genesis, 20, 1)
+	btc_sync()
+	db_test_corrupt(t)
+
+	var path string = COMBInfo.Path
+	db_close()
+	sync_test_reset(path)
+	db_is_new = false
+	if err := db_repair(); err != nil {
+		t.Fatal(err)
+	}
+	var corrupted map[uint64]struct{} = DBInfo.CorruptedBlocks
+
+	sync_test_load(t, path)
+	if len(DBInfo.CorruptedBlocks) != 0 || COMBInfo.Height != 11 {
+		t.Fatalf("at %d with %v corrupted after repairing", COMBInfo.Height, DBInfo.CorruptedBlocks)
+	}
+	DBInfo.CorruptedBlocks = corrupted
+	db_test_check_corrupted(t)
+	btc_sync()
+	sync_test_check(t, chain, 0)
+}
+
+func TestRollingFingerprint(t *testing.T) {
+	var chain *MockChain = sync_test_start(t, 0)
+	var a [][32]byte = mock_extend(chain, chain.Genesis, 30, 1)
+	btc_sync()
+
+	var before [][32]byte = [][32]byte{{}}
+	for h := uint64(1); h <= 30; h++ {
+		var metadata BlockMetadata = db_get_block_by_height(h)
+		if metadata.Rolling != db_compute_rolling_fingerprint(before[h-1], metadata.Fingerprint) {
+			t.Fatalf("block %d has rolling fingerprint %X", h, metadata.Rolling)
+		}
+		before = append(before, metadata.Rolling)
+	}
+
+	//bisecting against the fingerprints from before the reorg finds the fork
+	mock_extend(chain, a[15], 20, 2)
+	btc_sync()
+	sync_test_check(t, chain, 0)
+	var low, high uint64 = 1, 30
+	for low < high {
+		var mid uint64 = (low + high) / 2
+		if db_get_block_by_height(mid).Rolling == before[mid] {
+			low = mid + 1
+		} else {
+			high = mid
+		}
+	}
+	if low != 17 {
+		t.Fatalf("bisected to %d, expected 17", low)
+	}
+
+	//version 2 dbs get them computed when migrated
+	var rollings [][32]byte = [][32]byte{{}}
+	for h := uint64(1); h <= 36; h++ {
+		var metadata BlockMetadata = db_get_block_by_height(h)
+		rollings = append(rollings, metadata.Rolling)
+		key, value := encode_block_metadata(metadata)
+		db.Put(key[:], value[:96])
+	}
+	var version [DB_VERSION_KEY_LENGTH]byte
+	db.Put(version[:], []byte{0, 2})
+	DBInfo.Version = db_get_version()
+	if err := db_migrate(); err != nil {
+		t.Fatal(err)
+	}
+	for h := uint64(1); h <= 36; h++ {
+		if metadata := db_get_block_by_height(h); metadata.Rolling != rollings[h] {
+			t.Fatalf("block %d migrated to rolling fingerprint %X, expected %X", h, metadata.Rolling, rollings[h])
+		}
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	var chain *MockChain = sync_test_start(t, 2)
+	mock_extend(chain, chain.Genesis, 30, 1)
+	btc_sync()
+	var path string = COMBInfo.Path
+	var file string = t.TempDir() + "/snapshot"
+	var trusted BlockMetadata = db_get_block_by_height(20)
+	db_close()
+
+	sync_test_reset(path)
+	db_is_new = false
+	if err := snapshot_export(file, "20"); err != nil {
+		t.Fatal(err)
+	}
+
+	//a fresh node only takes the snapshot if it ends at the trusted fingerprint
+	var fresh string = t.TempDir()
+	sync_test_reset(fresh)
+	if err := snapshot_import(file, stringify_hex(trusted.Hash)); err == nil {
+		t.Fatal("snapshot imported against the wrong fingerprint")
+	}
+	data, _ := os.ReadFile(file)
+	data[100] ^= 1
+	os.WriteFile(file+".bad", data, 0644)
+	if err := snapshot_import(file+".bad", stringify_hex(trusted.Rolling)); err == nil {
+		t.Fatal("corrupted snapshot imported")
+	}
+	db_is_new = false
+	if err := snapshot_import(file, stringify_hex(trusted.Rolling)); err != nil {
+		t.Fatal(err)
+	}
+
+	//and carries on syncing from there
+	sync_test_load(t, fresh)
+	if COMBInfo.Height != 20 || COMBInfo.Hash != trusted.Hash {
+		t.Fatalf("loaded to %X (%d), expected %X (20)", COMBInfo.Hash, COMBInfo.Height, trusted.Hash)
+	}
+	mock_extend(chain, chain.Tip, 5, 1)
+	btc_sync()
+	sync_test_check(t, chain, 2)
+}
@@ -7,6 +7,7 @@ import (
 	"log"
 	"net"
 	"net/http"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -15,6 +16,8 @@ import (
 	"github.com/gorilla/mux"
 )
 
+const API_MAX_BLOCKS = 1000
+
 var gapi_db_mutex sync.Mutex
 var gcontrol *Control
 
@@ -28,22 +31,8 @@ func ghetto_rpc() {
 			log.Fatal(err6)
 		}
 
-		publicr := mux.NewRouter()
-		s0 := publicr.PathPrefix("/public").Subrouter()
-
-		s0.HandleFunc("/lib/get_commit_count", api_lib_get_commit_count)
-		s0.HandleFunc("/lib/get_height", api_lib_get_height)
-		s0.HandleFunc("/lib/get_block_commits/{block}", api_lib_get_block_commits)
-		s0.HandleFunc("/lib/get_block_by_height/{height}", api_lib_get_block_by_height)
-		s0.HandleFunc("/lib/get_block_by_hash/{hash}", api_lib_get_block_by_hash)
-		s0.HandleFunc("/lib/get_block_coinbase_commit/{block}", api_lib_get_block_coinbase_commit)
-
-		s0.HandleFunc("/db/get_block_metadata_by_height/{height}", api_db_get_block_metadata_by_height)
-		s0.HandleFunc("/db/get_full_block_by_height/{height}", api_db_get_full_block_by_height)
+		publicr := ghetto_public_router()
 
-
-
-		
 		srv := &http.Server{
 			Handler: publicr,
 			WriteTimeout: 24 * time.Hour,
@@ -64,7 +53,7 @@ func ghetto_rpc() {
 	
 	// Private
 	// !!! This is not secure for normal use currently !!!
-	if *private_api_bind != "" {
+	if *private_api_bind != "" && *node_mode != LIGHT_NODE { // only db routes here
 		privateln, err6 := net.Listen("tcp", *private_api_bind)
 		if err6 != nil {
 			log.Fatal(err6)
@@ -93,6 +82,32 @@ func ghetto_rpc() {
 
 }
 
+func ghetto_public_router() *mux.Router {
+	publicr := mux.NewRouter()
+	s0 := publicr.PathPrefix("/public").Subrouter()
+
+	s0.HandleFunc("/lib/get_commit_count", api_lib_get_commit_count)
+	s0.HandleFunc("/lib/get_height", api_lib_get_height)
+	s0.HandleFunc("/lib/get_block_commits/{block}", api_lib_get_block_commits)
+	s0.HandleFunc("/lib/get_block_coinbase_commit/{block}", api_lib_get_block_coinbase_commit)
+	s0.HandleFunc("/lib/get_commit_tag/{commit}", api_lib_get_commit_tag)
+	s0.HandleFunc("/lib/get_address_balance/{address}", api_lib_get_address_balance)
+	s0.HandleFunc("/lib/get_coin_history/{address}", api_lib_get_coin_history)
+
+	// Light nodes keep no commit db, so they dont serve anything read from it
+	if *node_mode != LIGHT_NODE {
+		s0.HandleFunc("/lib/get_block_by_height/{height}", api_lib_get_block_by_height)
+		s0.HandleFunc("/lib/get_block_by_hash/{hash}", api_lib_get_block_by_hash)
+
+		s0.HandleFunc("/db/get_block_metadata_by_height/{height}", api_db_get_block_metadata_by_height)
+		s0.HandleFunc("/db/get_full_block_by_height/{height}", api_db_get_full_block_by_height)
+		s0.HandleFunc("/db/get_blocks_by_height/{height}/{count}", api_db_get_blocks_by_height)
+		s0.HandleFunc("/db/find_commit/{commit}", api_db_find_commit)
+		s0.HandleFunc("/db/get_last_block", api_db_get_last_block)
+	}
+	return publicr
+}
+
 
 type commitTagPair struct {
 	commit string
@@ -146,10 +161,39 @@ func api_lib_get_commit_count(w http.ResponseWriter, r *http.Request) {
 }
 
 func api_lib_get_block_by_height(w http.ResponseWriter, r *http.Request) {
+	// Replies with the blocks metadata (including its rolling fingerprint), or null if it isn't stored
+	vars := mux.Vars(r)
+	h, err := strconv.ParseUint(vars["height"], 10, 64)
+	if err != nil {
+		fmt.Fprintf(w, err.Error())
+		return
+	}
+	var block *BlockMetadata
+	gapi_db_mutex.Lock()
+	if metadata := db_get_block_by_height(h); metadata.Height == h && metadata.Hash != empty {
+		block = &metadata
+	}
+	gapi_db_mutex.Unlock()
+	out, _ := json.Marshal(block)
+	fmt.Fprint(w, string(out))
 }
 
 func api_lib_get_block_by_hash(w http.ResponseWriter, r *http.Request) {
-
+	// Replies with the blocks metadata, or null if it isn't stored
+	vars := mux.Vars(r)
+	hash, err := parse_hex(vars["hash"])
+	if err != nil {
+		fmt.Fprintf(w, err.Error())
+		return
+	}
+	var block *BlockMetadata
+	gapi_db_mutex.Lock()
+	if metadata, err := db_get_block_by_hash(hash); err == nil {
+		block = &metadata
+	}
+	gapi_db_mutex.Unlock()
+	out, _ := json.Marshal(block)
+	fmt.Fprint(w, string(out))
 }
 
 func api_lib_get_block_coinbase_commit(w http.ResponseWriter, r *http.Request) {
@@ -170,6 +214,49 @@ func api_lib_get_block_coinbase_commit(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintf(w, fmt.Sprint(combbase))
 }
 
+func api_lib_get_commit_tag(w http.ResponseWriter, r *http.Request) {
+	// Replies with the tag of a commit, or null if it hasn't been mined. Used by LIGHT_NODE peers
+	vars := mux.Vars(r)
+	commit, err := parse_hex(vars["commit"])
+	if err != nil {
+		fmt.Fprintf(w, err.Error())
+		return
+	}
+	var tag *libcomb.Tag
+	if t, err := libcomb.GetCommitTag(commit); err == nil {
+		tag = &t
+	}
+	out, _ := json.Marshal(tag)
+	fmt.Fprint(w, string(out))
+}
+
+func api_lib_get_address_balance(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	address, err := parse_hex(vars["address"])
+	if err != nil {
+		fmt.Fprintf(w, err.Error())
+		return
+	}
+	fmt.Fprint(w, libcomb.GetBalance(address))
+}
+
+func api_lib_get_coin_history(w http.ResponseWriter, r *http.Request) {
+	// Only constructs known to this node are part of the history
+	vars := mux.Vars(r)
+	address, err := parse_hex(vars["address"])
+	if err != nil {
+		fmt.Fprintf(w, err.Error())
+		return
+	}
+	out := []string{}
+	for id := range libcomb.GetCoinHistory(address) {
+		out = append(out, stringify_hex(id))
+	}
+	sort.Strings(out) // peers are compared byte for byte by light nodes
+	data, _ := json.Marshal(out)
+	fmt.Fprint(w, string(data))
+}
+
 func api_db_get_block_metadata_by_height(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	h, err:= strconv.Atoi(vars["height"])
@@ -192,6 +279,24 @@ func api_db_get_block_metadata_by_height(w http.ResponseWriter, r *http.Request)
 	fmt.Fprint(w, string(out))
 }
 
+func api_db_find_commit(w http.ResponseWriter, r *http.Request) {
+	// Replies with every tag a commit was mined at (fast with comb_fingerprint_index, a full scan otherwise)
+	vars := mux.Vars(r)
+	commit, err := parse_hex(vars["commit"])
+	if err != nil {
+		fmt.Fprintf(w, err.Error())
+		return
+	}
+	gapi_db_mutex.Lock()
+	var tags []libcomb.Tag = db_find_commits(commit)
+	gapi_db_mutex.Unlock()
+	if tags == nil {
+		tags = []libcomb.Tag{}
+	}
+	out, _ := json.Marshal(tags)
+	fmt.Fprint(w, string(out))
+}
+
 func api_db_get_full_block_by_height(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	h, err:= strconv.Atoi(vars["height"])
@@ -213,6 +318,53 @@ func api_db_get_full_block_by_height(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprint(w, string(out))
 }
 
+func api_db_get_blocks_by_height(w http.ResponseWriter, r *http.Request) {
+	// Returns up to count blocks (metadata and commits) starting at height, used by MID_NODE peers to sync
+	vars := mux.Vars(r)
+	h, err := strconv.ParseUint(vars["height"], 10, 64)
+	if err != nil {
+		fmt.Println("conv error:", err, vars["height"])
+		log.Println("conv error:", err, vars["height"])
+		return
+	}
+	count, err := strconv.ParseUint(vars["count"], 10, 64)
+	if err != nil || count == 0 {
+		fmt.Println("conv error:", err, vars["count"])
+		log.Println("conv error:", err, vars["count"])
+		return
+	}
+	if count > API_MAX_BLOCKS {
+		count = API_MAX_BLOCKS
+	}
+
+	var blocks chan Block = make(chan Block)
+	var raw_data []Block = []Block{}
+	gapi_db_mutex.Lock()
+	go db_load_blocks(h, h+count-1, blocks)
+	for block := range blocks {
+		if block.Metadata.Hash != empty { // db_load_blocks leads with an empty block
+			raw_data = append(raw_data, block)
+		}
+	}
+	gapi_db_mutex.Unlock()
+
+	out, err := json.Marshal(raw_data)
+	if err != nil {
+		fmt.Println("ERROR marshalling block data", err)
+		log.Fatal("ERROR marshalling block data", err)
+	}
+
+	fmt.Fprint(w, string(out))
+}
+
+func api_db_get_last_block(w http.ResponseWriter, r *http.Request) {
+	// Replies with the metadata of the highest stored block. Provisional blocks are not stored, so this is as far as MID_NODE peers can sync
+	gapi_db_mutex.Lock()
+	raw_data := db_get_last_block()
+	gapi_db_mutex.Unlock()
+	out, _ := json.Marshal(raw_data)
+	fmt.Fprint(w, string(out))
+}
 
 // --- Private ---
 func api_db_remove_blocks_after_height(w http.ResponseWriter, r *http.Request) {
@@ -230,7 +382,7 @@ func api_db_remove_blocks_after_height(w http.ResponseWriter, r *http.Request) {
 	gapi_db_mutex.Lock()
 	defer gapi_db_mutex.Unlock()
 	md := db_get_block_by_height(uint64(h))
-	combcore_reorg(md.Hash)
+	neominer_reorg(md.Hash)
 }
 
 func api_db_push_block(w http.ResponseWriter, r *http.Request) {
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"libcomb"
+)
+
+//LIGHT_NODE keeps no commit db, every commit lookup is sent to the trusted peers instead
+
+const LIGHT_QUERY_ATTEMPTS = 3
+const LIGHT_QUERY_RETRY = time.Second
+
+func light_query_peer(url string, paths []string) (height uint64, answers [][]byte, moved bool, err error) {
+	//the answers only count if the peer stayed on the same block while giving them
+	var after uint64
+	if height, err = peer_get_height(Peers.Client, url); err != nil {
+		return 0, nil, false, err
+	}
+	for _, path := range paths {
+		var answer []byte
+		if answer, err = peer_call(Peers.Client, url+path); err != nil {
+			return 0, nil, false, err
+		}
+		answers = append(answers, bytes.TrimSpace(answer))
+	}
+	if after, err = peer_get_height(Peers.Client, url); err != nil {
+		return 0, nil, false, err
+	}
+	if after != height {
+		return 0, nil, true, fmt.Errorf("moved from block %d to %d while answering", height, after)
+	}
+	return height, answers, false, nil
+}
+
+func light_query_batch(paths []string) (data [][]byte, err error) {
+	//ask every peer, if more than one answers then they all have to be at the same height and agree
+	//peers a block apart are asked again, they usually catch up with each other quickly
+	for attempt := 1; ; attempt++ {
+		var height uint64
+		var answers int
+		var aligned bool = true
+		for _, url := range Peers.URLs {
+			var h uint64
+			var answer [][]byte
+			var moved bool
+			if h, answer, moved, err = light_query_peer(url, paths); err != nil {
+				aligned = aligned && !moved
+				log.Printf("(light) %s unavailable (%s)\n", url, err.Error())
+				continue
+			}
+			if answers > 0 && h != height {
+				aligned = false
+				break
+			}
+			if answers > 0 {
+				for i := range paths {
+					if !bytes.Equal(answer[i], data[i]) {
+						return nil, fmt.Errorf("peers disagree on %s at block %d", paths[i], height)
+					}
+				}
+			}
+			height, data = h, answer
+			answers++
+		}
+		if aligned && answers != 0 {
+			return data, nil
+		}
+		if aligned {
+			return nil, fmt.Errorf("no peers available")
+		}
+		if attempt == LIGHT_QUERY_ATTEMPTS {
+			return nil, fmt.Errorf("peers are not at a common height")
+		}
+		time.Sleep(LIGHT_QUERY_RETRY)
+	}
+}
+
+func light_query(path string) (data []byte, err error) {
+	var answers [][]byte
+	if answers, err = light_query_batch([]string{path}); err != nil {
+		return nil, err
+	}
+	return answers[0], nil
+}
+
+func light_get_tag(commit [32]byte) (tag libcomb.Tag, found bool, err error) {
+	var data []byte
+	var reply *libcomb.Tag
+	if data, err = light_query(fmt.Sprintf("/lib/get_commit_tag/%X", commit)); err != nil {
+		return tag, false, err
+	}
+	if err = json.Unmarshal(data, &reply); err != nil {
+		return tag, false, fmt.Errorf("tag is gibberish (%s) got (%s)", err.Error(), string(data))
+	}
+	if reply == nil {
+		return tag, false, nil
+	}
+	return *reply, true, nil
+}
+
+func light_parse_balance(data []byte) (balance uint64, err error) {
+	if balance, err = strconv.ParseUint(string(data), 10, 64); err != nil {
+		return 0, fmt.Errorf("balance is gibberish (%s) got (%s)", err.Error(), string(data))
+	}
+	return balance, nil
+}
+
+func light_get_balance(address [32]byte) (balance uint64, err error) {
+	var data []byte
+	if data, err = light_query(fmt.Sprintf("/lib/get_address_balance/%X", address)); err != nil {
+		return 0, err
+	}
+	return light_parse_balance(data)
+}
+
+func light_get_balances(addresses [][32]byte) (balances map[[32]byte]uint64, err error) {
+	//one round for the whole wallet, so every balance is from the same block
+	var paths []string
+	var data [][]byte
+	for _, address := range addresses {
+		paths = append(paths, fmt.Sprintf("/lib/get_address_balance/%X", address))
+	}
+	balances = make(map[[32]byte]uint64)
+	if len(paths) == 0 {
+		return balances, nil
+	}
+	if data, err = light_query_batch(paths); err != nil {
+		return nil, err
+	}
+	for i, address := range addresses {
+		if balances[address], err = light_parse_balance(data[i]); err != nil {
+			return nil, err
+		}
+	}
+	return balances, nil
+}
+
+func light_get_coin_history(address [32]byte) (history map[[32]byte]struct{}, err error) {
+	var data []byte
+	var ids []string
+	if data, err = light_query(fmt.Sprintf("/lib/get_coin_history/%X", address)); err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(data, &ids); err != nil {
+		return nil, fmt.Errorf("history is gibberish (%s) got (%s)", err.Error(), string(data))
+	}
+	history = make(map[[32]byte]struct{})
+	for _, i := range ids {
+		var id [32]byte
+		if id, err = parse_hex(i); err != nil {
+			return nil, err
+		}
+		history[id] = struct{}{}
+	}
+	return history, nil
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+//trusted peers that answer balance lookups from a table, at whatever height they are told to be at
+
+type LightTestPeer struct {
+	Lock     sync.Mutex
+	Height   uint64
+	Balances map[string]uint64
+	Heights  []uint64 //heights to report next, before settling on Height
+}
+
+func light_test_peer(t *testing.T, peer *LightTestPeer) string {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		peer.Lock.Lock()
+		defer peer.Lock.Unlock()
+		switch {
+		case r.URL.Path == "/public/lib/get_height":
+			var height uint64 = peer.Height
+			if len(peer.Heights) != 0 {
+				height, peer.Heights = peer.Heights[0], peer.Heights[1:]
+			}
+			fmt.Fprint(w, height)
+		case strings.HasPrefix(r.URL.Path, "/public/lib/get_address_balance/"):
+			fmt.Fprint(w, peer.Balances[strings.TrimPrefix(r.URL.Path, "/public/lib/get_address_balance/")])
+		default:
+			http.Error(w, "not found", http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server.URL + "/public"
+}
+
+func light_test_start(t *testing.T, peers ...*LightTestPeer) {
+	Peers.Client = &http.Client{}
+	Peers.URLs = nil
+	for _, peer := range peers {
+		Peers.URLs = append(Peers.URLs, light_test_peer(t, peer))
+	}
+	t.Cleanup(func() { Peers.URLs = nil })
+}
+
+func TestLightBalances(t *testing.T) {
+	var a, b [32]byte = [32]byte{1}, [32]byte{2}
+	var balances = map[string]uint64{fmt.Sprintf("%X", a): 5, fmt.Sprintf("%X", b): 7}
+	light_test_start(t, &LightTestPeer{Height: 10, Balances: balances}, &LightTestPeer{Height: 10, Balances: balances})
+
+	result, err := light_get_balances([][32]byte{a, b})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result[a] != 5 || result[b] != 7 {
+		t.Fatalf("got %v", result)
+	}
+}
+
+func TestLightDisagree(t *testing.T) {
+	var a [32]byte = [32]byte{1}
+	light_test_start(t,
+		&LightTestPeer{Height: 10, Balances: map[string]uint64{fmt.Sprintf("%X", a): 5}},
+		&LightTestPeer{Height: 10, Balances: map[string]uint64{fmt.Sprintf("%X", a): 6}})
+
+	if _, err := light_get_balance(a); err == nil {
+		t.Fatal("peers at the same height disagreed, but the lookup succeeded")
+	}
+}
+
+func TestLightCommonHeight(t *testing.T) {
+	//the second peer is a block behind (with an older balance) on the first round, then catches up
+	var a [32]byte = [32]byte{1}
+	var behind *LightTestPeer = &LightTestPeer{Height: 11, Balances: map[string]uint64{fmt.Sprintf("%X", a): 5}, Heights: []uint64{10, 10}}
+	light_test_start(t, &LightTestPeer{Height: 11, Balances: map[string]uint64{fmt.Sprintf("%X", a): 5}}, behind)
+
+	balance, err := light_get_balance(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if balance != 5 {
+		t.Fatalf("got %d", balance)
+	}
+
+	//a peer that never catches up fails the lookup instead of being compared at another height
+	behind.Lock.Lock()
+	behind.Height = 10
+	behind.Balances[fmt.Sprintf("%X", a)] = 4
+	behind.Lock.Unlock()
+	if _, err = light_get_balance(a); err == nil {
+		t.Fatal("peers never reached a common height, but the lookup succeeded")
+	}
+}
+
+func TestLightRoutes(t *testing.T) {
+	//without a db only the libcomb lookups are served, the db routes are not found instead of crashing
+	var mode uint = *node_mode
+	*node_mode = LIGHT_NODE
+	defer func() { *node_mode = mode }()
+	server := httptest.NewServer(ghetto_public_router())
+	defer server.Close()
+
+	for path, status := range map[string]int{
+		"/public/lib/get_height":                             http.StatusOK,
+		"/public/lib/get_block_by_height/1":                  http.StatusNotFound,
+		"/public/db/get_last_block":                          http.StatusNotFound,
+		"/public/db/get_blocks_by_height/1/10":               http.StatusNotFound,
+		"/public/db/get_block_metadata_by_height/1":          http.StatusNotFound,
+		"/public/db/find_commit/" + strings.Repeat("00", 32): http.StatusNotFound,
+	} {
+		response, err := http.Get(server.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		response.Body.Close()
+		if response.StatusCode != status {
+			t.Fatalf("%s gave %s, expected %d", path, response.Status, status)
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"io"
 	"log"
@@ -18,14 +19,35 @@ func main() {
 
 	combcore_set_status("Initializing...")
 	combcore_init()
+	if flag.NArg() != 0 { // offline db commands, these exit when done
+		switch flag.Arg(0) {
+		case "repair": // check the db and remove corrupted blocks
+			err = db_repair()
+		case "export-snapshot":
+			err = snapshot_export(flag.Arg(1), flag.Arg(2))
+		case "import-snapshot":
+			err = snapshot_import(flag.Arg(1), flag.Arg(2))
+		default:
+			err = fmt.Errorf("unknown command %s", flag.Arg(0))
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
 	neominer_init()
+	if *node_mode == MID_NODE || *node_mode == LIGHT_NODE {
+		peer_init()
+	}
 	rpc_start()
 
-	if err = db_open(); err != nil {
-		log.Fatal(err)
+	if *node_mode != LIGHT_NODE { // light nodes keep no commit db
+		if err = db_open(); err != nil {
+			log.Fatal(err)
+		}
+		combcore_set_status("Loading...")
+		db_start()
 	}
-	combcore_set_status("Loading...")
-	db_start()
 	combcore_set_status("Idle")
 
 	fmt.Println("Nodetype = ", fmt.Sprint(*node_mode))
@@ -40,12 +62,13 @@ func main() {
 		for {
 			btc_sync()
 			combcore_set_status("Idle")
-			time.Sleep(time.Second * 10)
+			btc_wait(time.Second * 10)
 		}
 
 	case MID_NODE:
-		// Insert the appropriate peer check when it exists
 		for {
+			peer_sync()
+			combcore_set_status("Idle")
 			time.Sleep(time.Second * 10)
 		}
 		
@@ -2,6 +2,7 @@ package main
 
 import (
 	"log"
+	"sync"
 
 	"libcomb"
 
@@ -12,6 +13,9 @@ var NeoInfo struct {
 	BatchCapacity uint64
 	BatchCached   uint64
 	Batch         *leveldb.Batch
+	Depth         uint64     //confirmations before a block is written to the db
+	Pending       []Block    //provisional blocks, loaded into libcomb but not stored
+	Lock          sync.Mutex //held while the sync changes libcomb or Pending, so rpcs see them agree
 }
 
 func neominer_inspect() {
@@ -20,12 +24,67 @@ func neominer_inspect() {
 	log.Println("COMB Node:")
 	log.Printf("\tVersion: %s\n", libcomb.Version)
 	log.Printf("\tHeight: %d\n", COMBInfo.Height)
+	log.Printf("\tFinal Height: %d\n", neominer_final_height())
 }
 
 func neominer_init() {
 	NeoInfo.BatchCapacity = 10000
 	NeoInfo.BatchCached = 0
 	NeoInfo.Batch = new(leveldb.Batch)
+	NeoInfo.Pending = nil
+	NeoInfo.Depth = 0
+	//blocks from peers are already buried, only our own btc tip can reorg
+	if *node_mode == FULL_NODE {
+		NeoInfo.Depth = uint64(*comb_confirmations)
+	}
+}
+
+func neominer_final_height() uint64 {
+	return COMBInfo.Height - uint64(len(NeoInfo.Pending))
+}
+
+func neominer_has_provisional_commits() bool {
+	//empty blocks dont change anything, so only pending commits can still be reorged away
+	NeoInfo.Lock.Lock()
+	defer NeoInfo.Lock.Unlock()
+	for _, block := range NeoInfo.Pending {
+		if len(block.Commits) != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func neominer_is_provisional(address [32]byte) bool {
+	//a balance depends on the pending blocks if they were first to commit the address or anything in its coin history
+	NeoInfo.Lock.Lock()
+	defer NeoInfo.Lock.Unlock()
+	var final uint64 = neominer_final_height()
+	if final == COMBInfo.Height {
+		return false
+	}
+	var ids [][32]byte = [][32]byte{address}
+	for id := range libcomb.GetCoinHistory(address) {
+		ids = append(ids, id)
+	}
+	for _, id := range ids {
+		if tag, err := libcomb.GetCommitTag(libcomb.Commit(id)); err == nil && tag.Height > final {
+			return true
+		}
+	}
+	return false
+}
+
+func neominer_reorg(target [32]byte) {
+	neominer_write() //flush the cache so we dont write back reorg'd blocks
+	NeoInfo.Lock.Lock()
+	defer NeoInfo.Lock.Unlock()
+	combcore_reorg(target, neominer_final_height())
+
+	//forget the provisional blocks that were rolled back
+	for len(NeoInfo.Pending) != 0 && NeoInfo.Pending[len(NeoInfo.Pending)-1].Metadata.Height > COMBInfo.Height {
+		NeoInfo.Pending = NeoInfo.Pending[:len(NeoInfo.Pending)-1]
+	}
 }
 
 func neominer_write() {
@@ -48,8 +107,7 @@ func neominer_process_block(block_data BlockData) (reorg bool) {
 		if _, ok := COMBInfo.Chain[block_data.Previous]; !ok { //check we actually have the previous block in the chain
 			log.Panicf("(neominer) chain broken, mining has fucked up\n")
 		}
-		neominer_write() //flush the cache so we dont write back reorg'd blocks
-		combcore_reorg(block_data.Previous)
+		neominer_reorg(block_data.Previous)
 	}
 
 	//check the rollback was successful
@@ -59,15 +117,23 @@ func neominer_process_block(block_data BlockData) (reorg bool) {
 
 	block.Metadata.Height = COMBInfo.Height + 1
 
-	if err = db_process_block(NeoInfo.Batch, block); err != nil {
-		log.Panicf("(neominer) ingest store block failed (%s)\n", err.Error())
-		return
-	}
-	NeoInfo.BatchCached++
+	NeoInfo.Lock.Lock()
 	if err = combcore_process_block(block); err != nil {
 		log.Panicf("(neominer) ingest process block failed (%s)\n", err.Error())
 	}
 
+	//only blocks buried deep enough are stored, shallow reorgs never touch the db
+	NeoInfo.Pending = append(NeoInfo.Pending, block)
+	for uint64(len(NeoInfo.Pending)) > NeoInfo.Depth {
+		if err = db_process_block(NeoInfo.Batch, NeoInfo.Pending[0]); err != nil {
+			log.Panicf("(neominer) ingest store block failed (%s)\n", err.Error())
+			return
+		}
+		NeoInfo.Pending = NeoInfo.Pending[1:]
+		NeoInfo.BatchCached++
+	}
+	NeoInfo.Lock.Unlock()
+
 	if NeoInfo.BatchCached >= NeoInfo.BatchCapacity {
 		neominer_write()
 	}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const PEER_BATCH_SIZE = 500
+
+var Peers struct {
+	Client *http.Client
+	URLs   []string
+}
+
+func peer_init() {
+	Peers.Client = &http.Client{Timeout: time.Minute}
+	Peers.URLs = nil
+	for _, p := range strings.Split(*comb_peers, ",") {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+		if !strings.HasPrefix(p, "http://") && !strings.HasPrefix(p, "https://") {
+			p = "http://" + p
+		}
+		Peers.URLs = append(Peers.URLs, strings.TrimSuffix(p, "/")+"/public")
+	}
+	if len(Peers.URLs) == 0 {
+		log.Printf("(peer) no peers configured (set comb_peers)\n")
+	}
+}
+
+func peer_call(client *http.Client, url string) (data []byte, err error) {
+	response, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	data, err = ioutil.ReadAll(response.Body)
+	response.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("peer returned %s", response.Status)
+	}
+	return data, nil
+}
+
+func peer_get_height(client *http.Client, url string) (height uint64, err error) {
+	var data []byte
+	if data, err = peer_call(client, fmt.Sprintf("%s/lib/get_height", url)); err != nil {
+		return 0, err
+	}
+	if height, err = strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64); err != nil {
+		return 0, fmt.Errorf("height is gibberish (%s) got (%s)", err.Error(), string(data))
+	}
+	return height, nil
+}
+
+func peer_get_metadata(client *http.Client, url string, height uint64) (metadata BlockMetadata, err error) {
+	var data []byte
+	if data, err = peer_call(client, fmt.Sprintf("%s/db/get_block_metadata_by_height/%d", url, height)); err != nil {
+		return metadata, err
+	}
+	if err = json.Unmarshal(data, &metadata); err != nil {
+		return metadata, fmt.Errorf("metadata is gibberish (%s) got (%s)", err.Error(), string(data))
+	}
+	//the db seeks to the next stored block, anything else means the peer doesnt have this height
+	if metadata.Height != height {
+		metadata = BlockMetadata{}
+	}
+	return metadata, nil
+}
+
+func peer_get_last_block(client *http.Client, url string) (metadata BlockMetadata, err error) {
+	var data []byte
+	if data, err = peer_call(client, fmt.Sprintf("%s/db/get_last_block", url)); err != nil {
+		return metadata, err
+	}
+	if err = json.Unmarshal(data, &metadata); err != nil {
+		return metadata, fmt.Errorf("metadata is gibberish (%s) got (%s)", err.Error(), string(data))
+	}
+	return metadata, nil
+}
+
+func peer_get_blocks(client *http.Client, url string, height uint64, count uint64) (blocks []Block, err error) {
+	var data []byte
+	if data, err = peer_call(client, fmt.Sprintf("%s/db/get_blocks_by_height/%d/%d", url, height, count)); err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(data, &blocks); err != nil {
+		return nil, fmt.Errorf("blocks are gibberish (%s)", err.Error())
+	}
+	return blocks, nil
+}
+
+func peer_select() (url string, height uint64, err error) {
+	//use whichever trusted peer is furthest ahead, by its stored blocks since provisional ones are not served
+	var found bool
+	for _, u := range Peers.URLs {
+		var last BlockMetadata
+		if last, err = peer_get_last_block(Peers.Client, u); err != nil {
+			log.Printf("(peer) %s unavailable (%s)\n", u, err.Error())
+			continue
+		}
+		if !found || last.Height > height {
+			url, height, found = u, last.Height, true
+		}
+	}
+	if !found {
+		return "", 0, fmt.Errorf("no peers available")
+	}
+	return url, height, nil
+}
+
+func peer_find_fork(url string) (height uint64, hash [32]byte, err error) {
+	//walk back from our tip until the peer agrees with us on the block at that height
+	var ok bool
+	var remote BlockMetadata
+	height = COMBInfo.Height
+	hash = COMBInfo.Hash
+	for {
+		if remote, err = peer_get_metadata(Peers.Client, url, height); err != nil {
+			return 0, hash, err
+		}
+		//an empty reply means we are below the peers first block (the checkpoint)
+		if remote.Hash == empty || remote.Hash == hash {
+			return height, hash, nil
+		}
+		if hash, ok = COMBInfo.Chain[hash]; !ok || hash == empty {
+			return 0, hash, fmt.Errorf("peer is on a different chain")
+		}
+		height--
+	}
+}
+
+func peer_check_block(block Block, previous [32]byte, height uint64) (err error) {
+	if block.Metadata.Height != height {
+		return fmt.Errorf("expected block %d, got %d", height, block.Metadata.Height)
+	}
+	if block.Metadata.Previous != previous {
+		return fmt.Errorf("block %d does not connect (%X != %X)", height, block.Metadata.Previous, previous)
+	}
+	if err = combcore_check_checkpoint(height, block.Metadata.Hash); err != nil {
+		return err
+	}
+	if fingerprint := db_compute_block_fingerprint(block.Commits); fingerprint != block.Metadata.Fingerprint {
+		return fmt.Errorf("fingerprint mismatch on block %d (%X != %X)", height, block.Metadata.Fingerprint, fingerprint)
+	}
+	return nil
+}
+
+func peer_sync() {
+	var err error
+	var url string
+	var target uint64
+	if url, target, err = peer_select(); err != nil {
+		log.Printf("(peer) failed to sync (%s)\n", err.Error())
+		return
+	}
+
+	var height uint64
+	var previous [32]byte
+	if height, previous, err = peer_find_fork(url); err != nil {
+		log.Printf("(peer) failed to find common block with %s (%s)\n", url, err.Error())
+		return
+	}
+
+	if height >= target {
+		return //nothing to do
+	}
+	if err = combcore_check_fork(height); err != nil {
+		log.Printf("(peer) rejecting chain from %s (%s)\n", url, err.Error())
+		return
+	}
+	var start uint64 = height
+	log.Printf("(peer) syncing %d blocks from %s...\n", int64(target)-int64(height), url)
+
+	defer neominer_write()
+	for height < target {
+		var blocks []Block
+		if blocks, err = peer_get_blocks(Peers.Client, url, height+1, PEER_BATCH_SIZE); err != nil {
+			log.Printf("(peer) failed to get blocks (%s)\n", err.Error())
+			return
+		}
+		if len(blocks) == 0 {
+			log.Printf("(peer) %s has no blocks after %d\n", url, height)
+			return
+		}
+		for _, block := range blocks {
+			if err = peer_check_block(block, previous, height+1); err != nil {
+				log.Printf("(peer) rejecting blocks from %s (%s)\n", url, err.Error())
+				return
+			}
+			neominer_process_block(BlockData{
+				Hash:     block.Metadata.Hash,
+				Previous: block.Metadata.Previous,
+				Commits:  block.Commits,
+			})
+			previous = block.Metadata.Hash
+			height++
+		}
+
+		var progress float64 = (float64(height-start) / float64(target-start)) * 100.0
+		combcore_set_status(fmt.Sprintf("Syncing (%.2f%%)...", progress))
+	}
+}
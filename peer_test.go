@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+//a trusted peer serving the blocks it has stored, while reporting a libcomb height that includes its pending blocks
+
+type PeerTestPeer struct {
+	Lock   sync.Mutex
+	Height uint64  //libcomb height, stored and pending blocks
+	Blocks []Block //stored blocks, from height 1
+	Past   int     //requests for blocks past the stored ones
+}
+
+func peer_test_peer(t *testing.T, peer *PeerTestPeer) string {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		peer.Lock.Lock()
+		defer peer.Lock.Unlock()
+		var height, count uint64
+		var out interface{}
+		switch {
+		case r.URL.Path == "/public/lib/get_height":
+			out = peer.Height
+		case r.URL.Path == "/public/db/get_last_block":
+			out = peer.Blocks[len(peer.Blocks)-1].Metadata
+		case peer_test_scan(r.URL.Path, "/public/db/get_block_metadata_by_height/%d", &height):
+			var metadata BlockMetadata
+			if height >= 1 && height <= uint64(len(peer.Blocks)) {
+				metadata = peer.Blocks[height-1].Metadata
+			}
+			out = metadata
+		case peer_test_scan(r.URL.Path, "/public/db/get_blocks_by_height/%d/%d", &height, &count):
+			var blocks []Block = []Block{}
+			for h := height; h < height+count && h <= uint64(len(peer.Blocks)); h++ {
+				blocks = append(blocks, peer.Blocks[h-1])
+			}
+			if len(blocks) == 0 {
+				peer.Past++
+			}
+			out = blocks
+		default:
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		data, _ := json.Marshal(out)
+		w.Write(data)
+	}))
+	t.Cleanup(server.Close)
+	return server.URL + "/public"
+}
+
+func peer_test_scan(path string, format string, args ...interface{}) bool {
+	n, err := fmt.Sscanf(path, format, args...)
+	return err == nil && n == len(args)
+}
+
+func TestPeerSyncPending(t *testing.T) {
+	//the peer is a full node with 3 pending blocks, a mid node can only sync what it stored
+	var chain *MockChain = sync_test_start(t, 3)
+	mock_extend(chain, chain.Genesis, 20, 1)
+	btc_sync()
+	sync_test_check(t, chain, 3)
+
+	var peer *PeerTestPeer = &PeerTestPeer{Height: COMBInfo.Height}
+	var blocks chan Block = make(chan Block)
+	go db_load_blocks(1, neominer_final_height(), blocks)
+	for block := range blocks {
+		if block.Metadata.Hash != empty {
+			peer.Blocks = append(peer.Blocks, block)
+		}
+	}
+	var last BlockMetadata = peer.Blocks[len(peer.Blocks)-1].Metadata
+
+	//a fresh mid node
+	db_close()
+	var mode uint = *node_mode
+	*node_mode = MID_NODE
+	t.Cleanup(func() { *node_mode = mode })
+	sync_test_load(t, t.TempDir())
+	Peers.Client = &http.Client{}
+	Peers.URLs = []string{peer_test_peer(t, peer)}
+	t.Cleanup(func() { Peers.URLs = nil })
+
+	url, target, err := peer_select()
+	if err != nil || url != Peers.URLs[0] || target != last.Height {
+		t.Fatalf("selected %s at %d (%v), expected %d", url, target, err, last.Height)
+	}
+	peer_sync()
+	if COMBInfo.Height != last.Height || COMBInfo.Hash != last.Hash {
+		t.Fatalf("at %X (%d), expected %X (%d)", COMBInfo.Hash, COMBInfo.Height, last.Hash, last.Height)
+	}
+	if stored := db_get_last_block(); stored.Hash != last.Hash {
+		t.Fatalf("stored up to %X, expected %X", stored.Hash, last.Hash)
+	}
+
+	//caught up, there is nothing to ask for until the peer stores more
+	peer_sync()
+	peer.Lock.Lock()
+	defer peer.Lock.Unlock()
+	if peer.Past != 0 {
+		t.Fatalf("asked for blocks past the peers last one %d times", peer.Past)
+	}
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/comparer"
+	"github.com/syndtr/goleveldb/leveldb/iterator"
+	"github.com/syndtr/goleveldb/leveldb/memdb"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+//what the commit db needs from a key value store, leveldb on disk or a memory store that never touches the filesystem
+
+type Storage interface {
+	Get(key []byte) ([]byte, error) //leveldb.ErrNotFound if its missing
+	Has(key []byte) (bool, error)
+	Put(key []byte, value []byte) error
+	Delete(key []byte) error
+	Write(batch *leveldb.Batch) error //all or nothing
+	NewIterator(slice *util.Range) iterator.Iterator
+	OpenTransaction() (StorageTransaction, error)
+	Close() error
+}
+
+type StorageTransaction interface {
+	//nothing is visible outside the transaction until its committed, iterators see its own writes made before they were opened
+	NewIterator(slice *util.Range) iterator.Iterator
+	Put(key []byte, value []byte) error
+	Delete(key []byte) error
+	Write(batch *leveldb.Batch) error
+	Commit() error
+	Discard()
+}
+
+type LevelStorage struct {
+	db *leveldb.DB
+}
+
+type LevelTransaction struct {
+	tr *leveldb.Transaction
+}
+
+func storage_open_level(path string) (storage *LevelStorage, is_new bool, err error) {
+	var lvldb *leveldb.DB
+	var options opt.Options
+	options.Compression = opt.NoCompression
+
+	//see if a db exists
+	options.ErrorIfMissing = true
+	lvldb, err = leveldb.OpenFile(path, &options)
+
+	if err != nil {
+		options.ErrorIfMissing = false
+		//may not exist, try create one
+		if lvldb, err = leveldb.OpenFile(path, &options); err != nil {
+			//actually was some other error
+			return nil, false, err
+		}
+		is_new = true
+	}
+	return &LevelStorage{db: lvldb}, is_new, nil
+}
+
+func (s *LevelStorage) Get(key []byte) ([]byte, error) {
+	return s.db.Get(key, nil)
+}
+
+func (s *LevelStorage) Has(key []byte) (bool, error) {
+	return s.db.Has(key, nil)
+}
+
+func (s *LevelStorage) Put(key []byte, value []byte) error {
+	return s.db.Put(key, value, nil)
+}
+
+func (s *LevelStorage) Delete(key []byte) error {
+	return s.db.Delete(key, nil)
+}
+
+func (s *LevelStorage) Write(batch *leveldb.Batch) error {
+	return s.db.Write(batch, &opt.WriteOptions{
+		Sync: true,
+	})
+}
+
+func (s *LevelStorage) NewIterator(slice *util.Range) iterator.Iterator {
+	return s.db.NewIterator(slice, nil)
+}
+
+func (s *LevelStorage) OpenTransaction() (StorageTransaction, error) {
+	tr, err := s.db.OpenTransaction()
+	if err != nil {
+		return nil, err
+	}
+	return &LevelTransaction{tr: tr}, nil
+}
+
+func (s *LevelStorage) Close() error {
+	return s.db.Close()
+}
+
+func (t *LevelTransaction) NewIterator(slice *util.Range) iterator.Iterator {
+	return t.tr.NewIterator(slice, nil)
+}
+
+func (t *LevelTransaction) Put(key []byte, value []byte) error {
+	return t.tr.Put(key, value, nil)
+}
+
+func (t *LevelTransaction) Delete(key []byte) error {
+	return t.tr.Delete(key, nil)
+}
+
+func (t *LevelTransaction) Write(batch *leveldb.Batch) error {
+	return t.tr.Write(batch, nil)
+}
+
+func (t *LevelTransaction) Commit() error {
+	return t.tr.Commit()
+}
+
+func (t *LevelTransaction) Discard() {
+	t.tr.Discard()
+}
+
+//the memory store is a leveldb memtable, unlike leveldb its iterators see writes made after they were opened
+
+type MemoryStorage struct {
+	lock sync.RWMutex //batches are applied whole
+	mem  *memdb.DB
+}
+
+type MemoryTransaction struct {
+	storage *MemoryStorage
+	batch   *leveldb.Batch
+}
+
+type MemoryReplay struct {
+	mem *memdb.DB
+}
+
+func storage_new_memory() *MemoryStorage {
+	return &MemoryStorage{mem: memdb.New(comparer.DefaultComparer, 0)}
+}
+
+func (r MemoryReplay) Put(key []byte, value []byte) {
+	r.mem.Put(key, value)
+}
+
+func (r MemoryReplay) Delete(key []byte) {
+	r.mem.Delete(key)
+}
+
+func (s *MemoryStorage) Get(key []byte) ([]byte, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	value, err := s.mem.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte{}, value...), nil
+}
+
+func (s *MemoryStorage) Has(key []byte) (bool, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.mem.Contains(key), nil
+}
+
+func (s *MemoryStorage) Put(key []byte, value []byte) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.mem.Put(key, value)
+}
+
+func (s *MemoryStorage) Delete(key []byte) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if err := s.mem.Delete(key); err != nil && err != leveldb.ErrNotFound {
+		return err
+	}
+	return nil
+}
+
+func (s *MemoryStorage) Write(batch *leveldb.Batch) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return batch.Replay(MemoryReplay{mem: s.mem})
+}
+
+func (s *MemoryStorage) NewIterator(slice *util.Range) iterator.Iterator {
+	return s.mem.NewIterator(slice)
+}
+
+func (s *MemoryStorage) OpenTransaction() (StorageTransaction, error) {
+	return &MemoryTransaction{storage: s, batch: new(leveldb.Batch)}, nil
+}
+
+func (s *MemoryStorage) Close() error {
+	s.mem.Reset()
+	return nil
+}
+
+func (t *MemoryTransaction) NewIterator(slice *util.Range) iterator.Iterator {
+	//like leveldb, reads see the transactions own writes, so replay them over a copy of the range
+	var overlay *memdb.DB = memdb.New(comparer.DefaultComparer, 0)
+	t.storage.lock.RLock()
+	iter := t.storage.mem.NewIterator(slice)
+	for iter.Next() {
+		overlay.Put(iter.Key(), iter.Value())
+	}
+	iter.Release()
+	t.storage.lock.RUnlock()
+	t.batch.Replay(MemoryReplay{mem: overlay})
+	return overlay.NewIterator(slice)
+}
+
+func (t *MemoryTransaction) Put(key []byte, value []byte) error {
+	t.batch.Put(key, value)
+	return nil
+}
+
+func (t *MemoryTransaction) Delete(key []byte) error {
+	t.batch.Delete(key)
+	return nil
+}
+
+func (t *MemoryTransaction) Write(batch *leveldb.Batch) error {
+	return batch.Replay(t.batch)
+}
+
+func (t *MemoryTransaction) Commit() error {
+	return t.storage.Write(t.batch)
+}
+
+func (t *MemoryTransaction) Discard() {
+	t.batch.Reset()
+}
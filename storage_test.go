@@ -0,0 +1,100 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+func storage_test_keys(t *testing.T, storage Storage, slice *util.Range) (keys []string) {
+	t.Helper()
+	iter := storage.NewIterator(slice)
+	for iter.Next() {
+		keys = append(keys, string(iter.Key())+"="+string(iter.Value()))
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		t.Fatal(err)
+	}
+	return keys
+}
+
+func storage_test_expect(t *testing.T, storage Storage, slice *util.Range, expected ...string) {
+	t.Helper()
+	var keys []string = storage_test_keys(t, storage, slice)
+	if len(keys) != len(expected) {
+		t.Fatalf("iterated %v, expected %v", keys, expected)
+	}
+	for i := range keys {
+		if keys[i] != expected[i] {
+			t.Fatalf("iterated %v, expected %v", keys, expected)
+		}
+	}
+}
+
+func TestStorage(t *testing.T) {
+	level, _, err := storage_open_level(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, storage := range map[string]Storage{"level": level, "memory": storage_new_memory()} {
+		t.Run(name, func(t *testing.T) {
+			defer storage.Close()
+
+			var batch *leveldb.Batch = new(leveldb.Batch)
+			batch.Put([]byte("b"), []byte("2"))
+			batch.Put([]byte("a"), []byte("1"))
+			batch.Put([]byte("c"), []byte("3"))
+			batch.Delete([]byte("c"))
+			if err := storage.Write(batch); err != nil {
+				t.Fatal(err)
+			}
+			storage.Put([]byte("d"), []byte("4"))
+			storage_test_expect(t, storage, nil, "a=1", "b=2", "d=4")
+			storage_test_expect(t, storage, &util.Range{Start: []byte("b"), Limit: []byte("d")}, "b=2")
+
+			if value, err := storage.Get([]byte("a")); err != nil || string(value) != "1" {
+				t.Fatalf("got %s (%v)", value, err)
+			}
+			if _, err := storage.Get([]byte("c")); err != leveldb.ErrNotFound {
+				t.Fatalf("deleted key gave %v", err)
+			}
+			storage.Delete([]byte("a"))
+			if ok, _ := storage.Has([]byte("a")); ok {
+				t.Fatal("deleted key still there")
+			}
+
+			//transactions land whole or not at all
+			tr, err := storage.OpenTransaction()
+			if err != nil {
+				t.Fatal(err)
+			}
+			tr.Put([]byte("e"), []byte("5"))
+			tr.Discard()
+			storage_test_expect(t, storage, nil, "b=2", "d=4")
+
+			if tr, err = storage.OpenTransaction(); err != nil {
+				t.Fatal(err)
+			}
+			tr.Put([]byte("e"), []byte("5"))
+			tr.Delete([]byte("b"))
+			storage_test_expect(t, storage, nil, "b=2", "d=4")
+
+			//but inside it they are seen, over the stored keys
+			var keys []string
+			iter := tr.NewIterator(nil)
+			for iter.Next() {
+				keys = append(keys, string(iter.Key())+"="+string(iter.Value()))
+			}
+			iter.Release()
+			if len(keys) != 2 || keys[0] != "d=4" || keys[1] != "e=5" {
+				t.Fatalf("transaction iterated %v, expected [d=4 e=5]", keys)
+			}
+			if err := tr.Commit(); err != nil {
+				t.Fatal(err)
+			}
+			storage_test_expect(t, storage, nil, "d=4", "e=5")
+		})
+	}
+}
@@ -339,23 +339,23 @@ func wallet_parse_unsigned_merkle_segment(c UnsignedMerkleSegment) (lc libcomb.U
 	return lc, err
 }
 
-func wallet_stringify_key(w libcomb.Key) (sw Key) {
+func wallet_stringify_key(w libcomb.Key, balances map[[32]byte]uint64) (sw Key) {
 	sw.Public = stringify_hex(w.Public)
 	for i := range w.Private {
 		sw.Private[i] = stringify_hex(w.Private[i])
 	}
-	sw.Balance = libcomb.GetBalance(w.Public)
+	sw.Balance = balances[w.Public]
 	sw.Active = w.Active()
 	return sw
 }
 
-func wallet_stringify_stack(s libcomb.Stack) (ss Stack) {
+func wallet_stringify_stack(s libcomb.Stack, balances map[[32]byte]uint64) (ss Stack) {
 	ss.Change = stringify_hex(s.Change)
 	ss.Destination = stringify_hex(s.Destination)
 	ss.Sum = s.Sum
 	ss.Address = stringify_hex(s.ID())
 	ss.Active = s.Active()
-	ss.Balance = libcomb.GetBalance(s.ID())
+	ss.Balance = balances[s.ID()]
 	return ss
 }
 
@@ -379,17 +379,17 @@ func wallet_stringify_decider(d libcomb.Decider) (sd Decider) {
 	return sd
 }
 
-func wallet_stringify_unsigned_merkle_segment(c libcomb.UnsignedMerkleSegment) (sc UnsignedMerkleSegment) {
+func wallet_stringify_unsigned_merkle_segment(c libcomb.UnsignedMerkleSegment, balances map[[32]byte]uint64) (sc UnsignedMerkleSegment) {
 	sc.Next = stringify_hex(c.Next)
 	sc.Root = stringify_hex(c.Root)
 	sc.Tips[0] = stringify_hex(c.Tips[0])
 	sc.Tips[1] = stringify_hex(c.Tips[1])
 	sc.ID = stringify_hex(c.ID())
-	sc.Balance = libcomb.GetBalance(c.ID())
+	sc.Balance = balances[c.ID()]
 	return sc
 }
 
-func wallet_stringify_merkle_segment(m libcomb.MerkleSegment) (sm MerkleSegment) {
+func wallet_stringify_merkle_segment(m libcomb.MerkleSegment, balances map[[32]byte]uint64) (sm MerkleSegment) {
 	sm.Tips[0] = stringify_hex(m.Tips[0])
 	sm.Tips[1] = stringify_hex(m.Tips[1])
 
@@ -405,7 +405,7 @@ func wallet_stringify_merkle_segment(m libcomb.MerkleSegment) (sm MerkleSegment)
 
 	sm.ID = stringify_hex(m.ID())
 	sm.Active = m.Active()
-	sm.Balance = libcomb.GetBalance(m.ID())
+	sm.Balance = balances[m.ID()]
 	sm.Root = stringify_hex(m.Root)
 	return sm
 }
@@ -419,13 +419,47 @@ type StringWallet struct {
 	UnsignedMerkles []UnsignedMerkleSegment
 }
 
-func wallet_stringify() StringWallet {
-	var w StringWallet
-	for _, k := range libcomb.GetKeys() {
-		w.Keys = append(w.Keys, wallet_stringify_key(k))
+func wallet_get_balances(addresses [][32]byte) (balances map[[32]byte]uint64, err error) {
+	//a light node has no commits of its own, so its balances come from the peers
+	if *node_mode == LIGHT_NODE {
+		return light_get_balances(addresses)
 	}
-	for _, s := range libcomb.GetStacks() {
-		w.Stacks = append(w.Stacks, wallet_stringify_stack(s))
+	balances = make(map[[32]byte]uint64)
+	for _, address := range addresses {
+		balances[address] = libcomb.GetBalance(address)
+	}
+	return balances, nil
+}
+
+func wallet_stringify() (w StringWallet, err error) {
+	var keys []libcomb.Key = libcomb.GetKeys()
+	var stacks []libcomb.Stack = libcomb.GetStacks()
+	var merkles []libcomb.MerkleSegment = libcomb.GetMerkleSegments()
+	var unsigned []libcomb.UnsignedMerkleSegment = libcomb.GetUnsignedMerkleSegments()
+
+	var addresses [][32]byte
+	for _, k := range keys {
+		addresses = append(addresses, k.Public)
+	}
+	for _, s := range stacks {
+		addresses = append(addresses, s.ID())
+	}
+	for _, m := range merkles {
+		addresses = append(addresses, m.ID())
+	}
+	for _, u := range unsigned {
+		addresses = append(addresses, u.ID())
+	}
+	var balances map[[32]byte]uint64
+	if balances, err = wallet_get_balances(addresses); err != nil {
+		return w, err
+	}
+
+	for _, k := range keys {
+		w.Keys = append(w.Keys, wallet_stringify_key(k, balances))
+	}
+	for _, s := range stacks {
+		w.Stacks = append(w.Stacks, wallet_stringify_stack(s, balances))
 	}
 	for _, tx := range libcomb.GetTransactions() {
 		w.TXs = append(w.TXs, wallet_stringify_transaction(tx))
@@ -433,13 +467,13 @@ func wallet_stringify() StringWallet {
 	for _, d := range libcomb.GetDeciders() {
 		w.Deciders = append(w.Deciders, wallet_stringify_decider(d))
 	}
-	for _, m := range libcomb.GetMerkleSegments() {
-		w.Merkles = append(w.Merkles, wallet_stringify_merkle_segment(m))
+	for _, m := range merkles {
+		w.Merkles = append(w.Merkles, wallet_stringify_merkle_segment(m, balances))
 	}
-	for _, u := range libcomb.GetUnsignedMerkleSegments() {
-		w.UnsignedMerkles = append(w.UnsignedMerkles, wallet_stringify_unsigned_merkle_segment(u))
+	for _, u := range unsigned {
+		w.UnsignedMerkles = append(w.UnsignedMerkles, wallet_stringify_unsigned_merkle_segment(u, balances))
 	}
-	return w
+	return w, nil
 }
 
 func wallet_export_key(w libcomb.Key) (out string) {